@@ -2,24 +2,40 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/jroimartin/gocui"
 	"github.com/roffe/ismtool/pkg/gui"
 	"github.com/roffe/ismtool/pkg/ism"
+	"github.com/roffe/ismtool/pkg/kline"
 	"github.com/roffe/ismtool/pkg/message"
 )
 
+// logTime is the communication.log time format, frames are logged at microsecond resolution
+const logTime = "15:04:05.000000"
+
 var (
 	defaultTimeout = 200 * time.Millisecond
+	// commandTimeout bounds a TUI command including the time queued behind other transponder transactions
+	commandTimeout = 5 * time.Second
 
-	portName string
+	portName      string
+	adapterName   string
+	adapterConfig string
+	minVoltage    float64
+	hwFilter      bool
+	loopback      bool
 
 	red   = color.New(color.FgRed).SprintFunc()
 	green = color.New(color.FgGreen).SprintFunc()
@@ -28,7 +44,12 @@ var (
 
 func init() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
-	flag.StringVar(&portName, "port", "COM6", "Port name")
+	flag.StringVar(&portName, "port", kline.J2534, "Port name, j2534, a serial port such as COM6 or /dev/ttyUSB0, or tcp://host:port")
+	flag.StringVar(&adapterName, "adapter", "", "Adapter name from the adapter config or an installed J2534 adapter, overrides -port")
+	flag.StringVar(&adapterConfig, "adapters", kline.DefaultAdapterConfigPath(), "Adapter config file")
+	flag.Float64Var(&minVoltage, "min-voltage", ism.DefaultMinVoltage, "Lowest supply voltage transponder writes are allowed at, 0 disables the check")
+	flag.BoolVar(&loopback, "loopback", false, "Have J2534 adapters read back transmitted frames to confirm them with the adapter timestamp")
+	flag.BoolVar(&hwFilter, "filter", false, "Have the adapter drop frames no command or state subscriber needs, the debug view and log only show what passes")
 	flag.Parse()
 }
 
@@ -108,6 +129,13 @@ func (r *Result) UnmarshalBinary(input []byte) error {
 }
 
 func main() {
+	if flag.Arg(0) == "sim" {
+		if err := runSim(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	start := time.Now()
 
 	g, err := gocui.NewGui(gocui.Output256)
@@ -121,16 +149,19 @@ func main() {
 	}
 	defer ui.Close()
 
-	client, err := ism.New(portName)
+	client, err := newClient(ism.Options{
+		OnError: func(err error) {
+			ui.WriteMessagef("Error: %v", err)
+		},
+		OnLinkState: func(state kline.LinkState) {
+			ui.WriteMessage("Link " + state.String())
+		},
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer client.Close()
 
-	client.OnError = func(err error) {
-		ui.WriteMessagef("Error: %v", err)
-	}
-
 	sc, err := os.Create("statechange.log")
 	if err != nil {
 		log.Fatal(err)
@@ -164,7 +195,9 @@ func main() {
 		}
 
 		if c == ism.KeyInserted && !keyInserted {
-			lastKey, err = client.ReadKeyIDE()
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			lastKey, err = client.ReadKeyIDE(ctx)
+			cancel()
 			if err == nil {
 				if bytes.Equal(lastKey.P0, []byte{0x25, 0xCC, 0x1E, 0x2C}) {
 					keyInserted = true
@@ -197,8 +230,22 @@ func main() {
 	}
 	defer f.Close()
 
+	// the adapter identification heads the log so a recording tells which interface and firmware it was made with
+	logInfo := func(info kline.AdapterInfo) {
+		f.Write([]byte(fmt.Sprintf(" AD: %-15s %s\n", time.Now().Format(logTime), info)))
+	}
+	info, err := client.K.AdapterInfo()
+	if err != nil {
+		ui.WriteMessagef("adapter info: %v", err)
+	}
+	logInfo(info)
+
 	client.K.OnIncoming = func(msg message.Message) {
-		f.Write([]byte(fmt.Sprintf(" IN: %-12s %d %d %X\n", time.Now().Format("15:04:05.999"), msg.ID(), len(msg.Data()), msg.Data())))
+		if rx, ok := msg.(*kline.RxMsg); ok {
+			f.Write([]byte(fmt.Sprintf(" IN: %-15s %d %d %X adapter %dus status %08X\n", rx.Received.Format(logTime), msg.ID(), len(msg.Data()), msg.Data(), rx.Timestamp, rx.RxStatus)))
+		} else {
+			f.Write([]byte(fmt.Sprintf(" IN: %-15s %d %d %X\n", time.Now().Format(logTime), msg.ID(), len(msg.Data()), msg.Data())))
+		}
 		switch msg.ID() {
 		case 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 12, 13, 15:
 			ui.WriteDebugf("%08d %s", time.Since(start).Milliseconds(), message.PrettyPrint(msg))
@@ -206,14 +253,48 @@ func main() {
 	}
 
 	client.K.OnOutgoing = func(msg message.Message) {
-		f.Write([]byte(fmt.Sprintf("OUT: %-12s %d %d %X\n", time.Now().Format("15:04:05.999"), msg.ID(), len(msg.Data()), msg.Data())))
+		tx, ok := msg.(*kline.TxMsg)
+		switch {
+		case ok && tx.Status == kline.TxConfirmed:
+			f.Write([]byte(fmt.Sprintf("OUT: %-15s %d %d %X %s %s adapter %dus\n", tx.Written.Format(logTime), msg.ID(), len(msg.Data()), msg.Data(), tx.Status, tx.Confirmed.Sub(tx.Written), tx.Timestamp)))
+		case ok:
+			f.Write([]byte(fmt.Sprintf("OUT: %-15s %d %d %X %s\n", tx.Written.Format(logTime), msg.ID(), len(msg.Data()), msg.Data(), tx.Status)))
+		default:
+			f.Write([]byte(fmt.Sprintf("OUT: %-15s %d %d %X\n", time.Now().Format(logTime), msg.ID(), len(msg.Data()), msg.Data())))
+		}
 		//ui.WriteMessagef("%08d %s", time.Since(start).Milliseconds(), message.PrettyPrint(msg))
 	}
 
+	client.TX.OnTransaction = func(tx kline.Transaction, res kline.TxResult, err error) {
+		status := "ok"
+		if err != nil {
+			status = err.Error()
+		}
+		f.Write([]byte(fmt.Sprintf(" TX: %-15s %X frames %d wait %s exec %s %s\n", time.Now().Format(logTime), tx.Request.Data(), len(res.Frames), res.Wait, res.Exec, status)))
+	}
+
 	client.K.OnError = func(err error) {
 		ui.WriteMessage("K> " + err.Error())
 	}
 
+	client.MinVoltage = minVoltage
+	client.K.OnVoltage = func(v kline.VoltageSample) {
+		f.Write([]byte(fmt.Sprintf(" VB: %-15s %.2f\n", v.At.Format(logTime), v.Volts)))
+		if v.Volts < client.MinVoltage {
+			ui.SetVoltage(red(v.String()))
+			return
+		}
+		ui.SetVoltage(v.String())
+	}
+	if err := client.K.PollVoltage(kline.DefaultVoltagePoll); err != nil {
+		ui.SetVoltage("n/a")
+	}
+	if hwFilter {
+		if err := client.K.FilterFrames(); err != nil {
+			ui.WriteMessagef("hardware filter: %v", err)
+		}
+	}
+
 	client.Log = func(str string) {
 		ui.WriteMessage(str)
 	}
@@ -267,7 +348,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	k := client.K
+	cmds := newCommands()
 	ui.CommandMap = map[string]func(){
 		"quit": ui.Close,
 		"q":    ui.Close,
@@ -299,46 +380,56 @@ func main() {
 			client.ReleaseKey()
 		},
 		"open": func() { // open (o)
-			msg, err := k.SendAndRecv(defaultTimeout, message.New(2, []byte{0x03, 0x1f}), 2)
-			if err != nil {
-				ui.WriteMessage(err.Error())
-				return
-			}
-			ui.WriteMessage("open: " + msg.String())
+			cmds.run(func(ctx context.Context) {
+				transponder(ctx, client, ui, "open", 0x03, 0x1f)
+			})
 		},
 		"rid": func() { //request IDE (i050C)
-			msg, err := k.SendAndRecv(defaultTimeout, message.New(2, []byte{0x04}), 2)
-			if err != nil {
-				ui.WriteMessage(err.Error())
-				return
-			}
-			ui.WriteMessage("request IDE (i050C): " + msg.String())
+			cmds.run(func(ctx context.Context) {
+				transponder(ctx, client, ui, "request IDE (i050C)", 0x04)
+			})
 		},
 		"rs": func() { // read status
-			msg, err := k.SendAndRecv(defaultTimeout, message.New(2, []byte{0x02, 0x06}), 2)
-			if err != nil {
-				ui.WriteMessage(err.Error())
-				return
-			}
-			ui.WriteMessage("read status: " + msg.String())
+			cmds.run(func(ctx context.Context) {
+				transponder(ctx, client, ui, "read status", 0x02, 0x06)
+			})
 		},
 		"off": func() { // off (f)
-			msg, err := k.SendAndRecv(defaultTimeout, message.New(2, []byte{0x01}), 2)
+			cmds.run(func(ctx context.Context) {
+				transponder(ctx, client, ui, "off", 0x01)
+			})
+		},
+		"stats": func() {
+			writeStats(ui, client.K.Stats())
+			if mask := client.K.FilterMask(); mask != kline.AllIDs {
+				ui.WriteMessagef("hardware filter passes ids %s", filterIDs(mask))
+			}
+		},
+		"info": func() {
+			info, err := client.K.AdapterInfo()
 			if err != nil {
-				ui.WriteMessage(err.Error())
-				return
+				ui.WriteMessagef("adapter info: %v", err)
+			}
+			logInfo(info)
+			writeInfo(ui, info)
+		},
+		"queues": func() {
+			depth := client.K.QueueDepth()
+			ui.WriteMessagef("queued: control %d, command %d, periodic %d", depth[kline.PriorityControl], depth[kline.PriorityCommand], depth[kline.PriorityPeriodic])
+		},
+		"abort": func() {
+			if n := cmds.abort(); n > 0 {
+				ui.WriteMessagef("aborted %d command(s)", n)
 			}
-			ui.WriteMessage("off: " + msg.String())
 		},
 		"read": func() {
-			go func() {
-
-				k, err := client.ReadKeyIDE()
+			cmds.runTimeout(3*time.Second, func(ctx context.Context) {
+				k, err := client.ReadKeyIDE(ctx)
 				if err != nil {
 					ui.WriteMessage(err.Error())
 					return
 				}
-				ui.WriteMessagef("read: %X", k.P0)
+				ui.WriteMessagef("read: %X %X %X", k.P0, k.P1, k.P2)
 				/*
 					msg, err := k.SendAndRecv(defaultTimeout, message.New(2, []byte{0x03, 0x1f}), 2)
 					if err != nil {
@@ -368,7 +459,28 @@ func main() {
 					}
 					ui.WriteMessage("off: " + msg.String())
 				*/
-			}()
+			})
+		},
+	}
+
+	ui.ArgCommandMap = map[string]func(args []string){
+		"enrol": func(args []string) {
+			if len(args) != 1 {
+				ui.WriteMessage("usage: enrol <14 hex digits>")
+				return
+			}
+			data, err := hex.DecodeString(args[0])
+			if err != nil {
+				ui.WriteMessagef("enrol: %v", err)
+				return
+			}
+			cmds.runTimeout(5*time.Second, func(ctx context.Context) {
+				if err := client.EnrolKey(ctx, data); err != nil {
+					ui.WriteMessage(err.Error())
+					return
+				}
+				ui.WriteMessagef("enrol: wrote %X", data)
+			})
 		},
 	}
 
@@ -379,6 +491,140 @@ func main() {
 	}
 }
 
+// newClient connects through the -adapter registry entry if one was given, otherwise through -port
+func newClient(opts ism.Options) (*ism.Client, error) {
+	if adapterName == "" {
+		if portName == kline.J2534 {
+			cfg := kline.DefaultJ2534Config
+			cfg.Loopback = loopback
+			return ism.NewWithOptions(kline.NewJ2534Transport(cfg), opts)
+		}
+		return ism.NewWithOptions(kline.NewTransport(portName), opts)
+	}
+	reg, err := kline.LoadRegistry(adapterConfig)
+	if err != nil {
+		return nil, err
+	}
+	a, err := reg.Get(adapterName)
+	if err != nil {
+		return nil, err
+	}
+	// -loopback turns it on for every J2534 adapter, an adapter config can also turn it on by itself
+	a.Loopback = a.Loopback || loopback
+	t, err := a.Transport()
+	if err != nil {
+		return nil, err
+	}
+	return ism.NewWithOptions(t, opts)
+}
+
+func filterIDs(mask uint16) string {
+	var ids []string
+	for id := 0; id < 16; id++ {
+		if mask&(1<<id) != 0 {
+			ids = append(ids, strconv.Itoa(id))
+		}
+	}
+	if len(ids) == 0 {
+		return "none"
+	}
+	return strings.Join(ids, ",")
+}
+
+func writeInfo(ui *gui.Gui, info kline.AdapterInfo) {
+	if info.Library != "" {
+		ui.WriteMessagef("adapter: %s %s", info.Transport, info.Library)
+	} else {
+		ui.WriteMessagef("adapter: %s", info.Transport)
+	}
+	if info.Firmware != "" || info.DLL != "" || info.API != "" {
+		ui.WriteMessagef("  firmware %s, dll %s, api %s", info.Firmware, info.DLL, info.API)
+	}
+	for _, c := range info.Config {
+		ui.WriteMessagef("  %s", c)
+	}
+	if info.LastError != "" {
+		ui.WriteMessagef("  last error: %s", info.LastError)
+	}
+}
+
+func writeStats(ui *gui.Gui, st kline.Stats) {
+	ui.WriteMessagef("%s: in %d bytes, out %d bytes", st.Transport, st.BytesIn, st.BytesOut)
+	for id := range st.FramesIn {
+		if st.FramesIn[id] > 0 || st.FramesOut[id] > 0 {
+			ui.WriteMessagef("  id %2d: in %d, out %d", id, st.FramesIn[id], st.FramesOut[id])
+		}
+	}
+	ui.WriteMessagef("errors: read %d, write %d, collisions %d, subscriber drops %d", st.ReadErrors, st.WriteErrors, st.Collisions, st.SubscriberDrops)
+	if st.Decoder != nil {
+		ui.WriteMessagef("decoder: frames %d, bad %d, skipped bytes %d", st.Decoder.Frames, st.Decoder.BadFrames, st.Decoder.SkippedBytes)
+	}
+	keys := make([]string, 0, len(st.Latency))
+	for k := range st.Latency {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ui.WriteMessagef("latency %s: %s", k, st.Latency[k])
+	}
+}
+
+// commands runs TUI commands in the background so a slow or hung one can be aborted
+type commands struct {
+	mu      sync.Mutex
+	running map[*context.CancelFunc]bool
+}
+
+func newCommands() *commands {
+	return &commands{running: make(map[*context.CancelFunc]bool)}
+}
+
+// run runs fn with a context ending after commandTimeout or on abort
+func (c *commands) run(fn func(ctx context.Context)) {
+	c.runTimeout(commandTimeout, fn)
+}
+
+// transponder runs an id 2 command through the client transaction queue and prints the response with its timing
+func transponder(ctx context.Context, client *ism.Client, ui *gui.Gui, name string, cmd ...byte) {
+	res, err := client.Transponder(ctx, cmd...)
+	for _, msg := range res.Frames {
+		ui.WriteMessage(name + ": " + msg.String())
+	}
+	if err != nil {
+		ui.WriteMessage(err.Error())
+		return
+	}
+	ui.WriteMessagef("%s: queued %s, took %s", name, res.Wait.Round(time.Millisecond), res.Exec.Round(time.Millisecond))
+}
+
+func (c *commands) runTimeout(timeout time.Duration, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c.mu.Lock()
+	c.running[&cancel] = true
+	c.mu.Unlock()
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.running, &cancel)
+			c.mu.Unlock()
+			cancel()
+		}()
+		fn(ctx)
+	}()
+}
+
+// abort cancels all running commands and returns how many there were
+func (c *commands) abort() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.running)
+	for cancel := range c.running {
+		(*cancel)()
+		delete(c.running, cancel)
+	}
+	return n
+}
+
 /*
 func getBit(b byte, p int) uint8 {
 	return b & (1 << p) >> p
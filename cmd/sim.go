@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/roffe/ismtool/pkg/ismsim"
+	"github.com/roffe/ismtool/pkg/kline"
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// runSim serves a virtual ISM on a pseudo-terminal or a TCP listener, the key is moved with commands on stdin
+func runSim(args []string) error {
+	fs := flag.NewFlagSet("sim", flag.ExitOnError)
+	link := fs.String("link", ismsim.LinkName, "symlink pointing to the pseudo-terminal, empty to skip")
+	listen := fs.String("listen", "", "serve the raw K-line byte stream on this TCP address instead of a pseudo-terminal, e.g. 127.0.0.1:4001")
+	verbose := fs.Bool("v", false, "log frames received from the host")
+	echo := fs.Bool("echo", true, "echo received frames like a single-wire K-line cable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sim := ismsim.New()
+	sim.Echo = *echo
+	if *verbose {
+		sim.Log = func(msg message.Message) {
+			log.Println("<<", msg.String())
+		}
+	}
+
+	quit := make(chan struct{})
+	errs := make(chan error, 1)
+
+	if *listen != "" {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		log.Printf("virtual ISM on %s%s", kline.TCPScheme, l.Addr())
+		go simAccept(sim, l, quit)
+	} else {
+		pty, err := ismsim.OpenPTY()
+		if err != nil {
+			return err
+		}
+		defer pty.Close()
+
+		if *link != "" {
+			os.Remove(*link)
+			if err := os.Symlink(pty.Name, *link); err != nil {
+				return err
+			}
+			defer os.Remove(*link)
+		}
+
+		go func() {
+			errs <- sim.Serve(kline.NewStreamTransport(pty.Name, pty.Master, kline.DefaultStreamConfig), quit)
+		}()
+
+		log.Printf("virtual ISM on %s", pty.Name)
+		if *link != "" {
+			log.Printf("linked as %s", *link)
+		}
+	}
+	log.Println("commands: insert, half, on, start, remove, status")
+
+	go simCommands(sim)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case <-sig:
+		close(quit)
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// simAccept serves the ISM to every TCP client until the listener is closed
+func simAccept(sim *ismsim.ISM, l net.Listener, quit chan struct{}) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		log.Printf("client %s connected", conn.RemoteAddr())
+		go func() {
+			defer conn.Close()
+			err := sim.Serve(kline.NewStreamTransport(conn.RemoteAddr().String(), conn, kline.DefaultTCPStreamConfig), quit)
+			log.Printf("client %s disconnected: %v", conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+func simCommands(sim *ismsim.ISM) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var err error
+		switch strings.TrimSpace(scanner.Text()) {
+		case "insert":
+			sim.Insert(ismsim.DefaultKey)
+		case "half":
+			sim.HalfInsert(ismsim.DefaultKey)
+		case "on":
+			err = sim.TurnOn()
+		case "start":
+			err = sim.TurnStart()
+		case "remove":
+			sim.Remove()
+		case "status", "":
+		default:
+			err = fmt.Errorf("unknown command %q", scanner.Text())
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		log.Printf("key %s, released: %t, led: %02d", sim.Position(), sim.Released(), sim.LedBrightness())
+	}
+}
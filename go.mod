@@ -7,6 +7,7 @@ require (
 	github.com/fatih/color v1.14.1
 	github.com/jroimartin/gocui v0.5.0
 	go.bug.st/serial v1.5.0
+	golang.org/x/sys v0.5.0
 )
 
 require (
@@ -41,7 +42,6 @@ require (
 	golang.org/x/mobile v0.0.0-20211207041440-4e6c2922fdee // indirect
 	golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	honnef.co/go/js/dom v0.0.0-20210725211120-f030747120f2 // indirect
@@ -12,6 +12,9 @@ import (
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
+	"github.com/roffe/ismtool/pkg/ism"
+	"github.com/roffe/ismtool/pkg/ismsim"
+	"github.com/roffe/ismtool/pkg/kline"
 	"github.com/roffe/ismtool/ui"
 	"go.bug.st/serial/enumerator"
 )
@@ -24,6 +27,8 @@ type mainWindow struct {
 	rescanButton *widget.Button
 	portList     *widget.Select
 
+	client *ism.Client
+
 	statusbar *widget.Label
 	fyne.Window
 }
@@ -136,13 +141,59 @@ func (mw *mainWindow) layout() fyne.CanvasObject {
 		Trailing: container.NewVBox(
 			mw.rescanButton,
 			mw.portList,
-			widget.NewButton("Connect", func() {}),
+			widget.NewButton("Connect", mw.connect),
 			widget.NewButton("Read key", func() {}),
 			layout.NewSpacer(),
 		),
 	}
 	return container.NewBorder(nil, mw.statusbar, nil, nil, split)
 }
+
+// connect opens the selected port or adapter and shows its supply voltage in the status bar
+func (mw *mainWindow) connect() {
+	if mw.client != nil {
+		mw.client.Close()
+		mw.client = nil
+	}
+	if mw.port == "" {
+		mw.output("no port selected")
+		return
+	}
+	t, err := portTransport(mw.port)
+	if err != nil {
+		mw.output(err.Error())
+		return
+	}
+	client, err := ism.NewWithTransport(t)
+	if err != nil {
+		mw.output(err.Error())
+		return
+	}
+	port := mw.port
+	client.K.OnVoltage = func(v kline.VoltageSample) {
+		if v.Volts < client.MinVoltage {
+			mw.statusbar.SetText(fmt.Sprintf("%s, supply %s, too low for writes", port, v))
+			return
+		}
+		mw.statusbar.SetText(fmt.Sprintf("%s, supply %s", port, v))
+	}
+	mw.client = client
+	mw.statusbar.SetText("Connected to " + port)
+	if err := client.K.PollVoltage(kline.DefaultVoltagePoll); err != nil {
+		mw.statusbar.SetText(fmt.Sprintf("Connected to %s, %v", port, err))
+	}
+}
+
+// portTransport returns the transport of the adapter called name, or of the port name if there is no such adapter
+func portTransport(name string) (kline.Transport, error) {
+	// ListPorts already reported a broken config file, the default and installed adapters still work without it
+	reg, _ := kline.LoadRegistry(kline.DefaultAdapterConfigPath())
+	if _, err := reg.Get(name); err != nil {
+		return kline.NewTransport(name), nil
+	}
+	return reg.Transport(name)
+}
+
 func (mw *mainWindow) output(str string) {
 	lines := strings.Split(str, "\n")
 	for _, line := range lines {
@@ -158,6 +209,9 @@ func main() {
 	ismtool.Lifecycle().SetOnStarted(func() {
 	})
 	w.ShowAndRun()
+	if w.client != nil {
+		w.client.Close()
+	}
 }
 
 func ListPorts() (string, []string, error) {
@@ -166,10 +220,16 @@ func ListPorts() (string, []string, error) {
 	if err != nil {
 		return "", nil, err
 	}
-	if len(ports) == 0 {
-		return "", nil, errors.New("no serial ports found")
+	// a broken config file still leaves the default and installed adapters, and the serial ports
+	reg, cfgErr := kline.LoadRegistry(kline.DefaultAdapterConfigPath())
+	adapters := reg.List()
+	if len(ports) == 0 && len(ismsim.Ports()) == 0 && len(adapters) == 0 {
+		return "", nil, errors.New("no serial ports or adapters found")
 	}
 	var output strings.Builder
+	if cfgErr != nil {
+		output.WriteString(fmt.Sprintf("ignoring %v\n", cfgErr))
+	}
 
 	output.WriteString("detected ports:\n")
 	for i, port := range ports {
@@ -186,5 +246,18 @@ func ListPorts() (string, []string, error) {
 			portsList = append(portsList, port.Name)
 		}
 	}
+	for _, port := range ismsim.Ports() {
+		output.WriteString(fmt.Sprintf("  ┗ %s (virtual ISM)\n", port))
+		portsList = append(portsList, port)
+	}
+	output.WriteString("adapters:\n")
+	for i, a := range adapters {
+		jun := "┣"
+		if i+1 == len(adapters) {
+			jun = "┗"
+		}
+		output.WriteString(fmt.Sprintf("  %s %s\n", jun, a))
+		portsList = append(portsList, a.Name)
+	}
 	return output.String(), portsList, nil
 }
@@ -13,6 +13,8 @@ type CmdMap map[string]func()
 type Gui struct {
 	g          *gocui.Gui
 	CommandMap map[string]func()
+	// ArgCommandMap holds the commands that take arguments, they get the words typed after the command name
+	ArgCommandMap map[string]func(args []string)
 }
 
 func New(g *gocui.Gui) (*Gui, error) {
@@ -70,6 +72,11 @@ func (ui *Gui) layout(g *gocui.Gui) error {
 			"rs - read status",
 			"off - radio off",
 			"read - open, read close",
+			"abort - cancel running commands",
+			"queues - outgoing queue depths",
+			"stats - frame, error and latency counters",
+			"info - adapter versions and config",
+			"enrol <hex> - write 7 bytes key data",
 		}
 		fmt.Fprintln(v, strings.Join(commands, "\n"))
 	}
@@ -91,13 +98,22 @@ func (ui *Gui) layout(g *gocui.Gui) error {
 		v.Overwrite = true
 	}
 
+	if v, err := g.SetView("voltage", 26, maxY-3, 35, maxY-1); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		fmt.Fprint(v, "  --")
+		v.Title = "Vbatt"
+		v.Overwrite = true
+	}
+
 	input := &Input{
 		ui:        ui,
 		Name:      "input",
 		Title:     "Command",
-		X:         26,
+		X:         36,
 		Y:         maxY - 3,
-		W:         40,
+		W:         37,
 		MaxLength: 45,
 	}
 
@@ -192,3 +208,13 @@ func (ui *Gui) SetLED(value uint8) {
 		return nil
 	})
 }
+
+func (ui *Gui) SetVoltage(str string) {
+	ui.g.Update(func(g *gocui.Gui) error {
+		if v, err := g.View("voltage"); err == nil {
+			v.Clear()
+			fmt.Fprintf(v, " %s", str)
+		}
+		return nil
+	})
+}
@@ -57,9 +57,15 @@ func (i *Input) process(str string) {
 	if i.ui.CommandMap != nil {
 		if cmd, found := i.ui.CommandMap[str]; found {
 			cmd()
+			return
 		}
 
 	}
+	if fields := strings.Fields(str); len(fields) > 0 && i.ui.ArgCommandMap != nil {
+		if cmd, found := i.ui.ArgCommandMap[fields[0]]; found {
+			cmd(fields[1:])
+		}
+	}
 }
 
 type Box struct {
@@ -1,6 +1,8 @@
 package ism
 
 import (
+	"sync"
+
 	"github.com/roffe/ismtool/pkg/message"
 )
 
@@ -9,22 +11,33 @@ type codeDef struct {
 	data        []byte
 }
 
-var (
-	codeIndex = []int{-1, -3, -3, -2, -2}
-	codes     = make([][]byte, 5)
-)
+var codes = make([][]byte, 5)
+
+// packet10Codes steps through the id 10 code sequences, they start over after every init
+type packet10Codes struct {
+	mu    sync.Mutex
+	index []int
+}
+
+func (p *packet10Codes) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.index = []int{-1, -3, -3, -2, -2}
+}
 
-func generatePacket10() message.Message {
+func (p *packet10Codes) next() message.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	data := make([]byte, 5)
 	for idx := 0; idx < 5; idx++ {
-		if codeIndex[idx] < 0 {
+		if p.index[idx] < 0 {
 			data[idx] = 0
-			codeIndex[idx]++
+			p.index[idx]++
 		} else {
-			data[idx] = codes[idx][codeIndex[idx]]
-			codeIndex[idx]++
-			if codeIndex[idx] == len(codes[idx]) {
-				codeIndex[idx] = 0
+			data[idx] = codes[idx][p.index[idx]]
+			p.index[idx]++
+			if p.index[idx] == len(codes[idx]) {
+				p.index[idx] = 0
 			}
 		}
 	}
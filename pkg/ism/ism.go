@@ -2,7 +2,9 @@ package ism
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -12,7 +14,8 @@ import (
 )
 
 type Client struct {
-	K *kline.Engine // K-line client
+	K  *kline.Engine  // K-line client
+	TX *kline.TxQueue // id 2 transponder transactions, one at a time
 
 	internalState [2]byte
 	state         [3]byte
@@ -20,77 +23,126 @@ type Client struct {
 	ledBrightness uint8
 	keyReleased   bool
 
-	transmitPacket10 bool
-	transmitState    bool
+	packet10   *kline.Periodic // id 10 every 200ms
+	stateFrame *kline.Periodic // id 14 when lock or LED changes, at most every 100ms
 
 	stateSubscriptions map[*kline.Subscriber]bool
 
-	quit chan struct{}
+	codes packet10Codes
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  chan struct{} // closed once NewWithTransport has set up the client
+
+	// MinVoltage is the lowest supply voltage TransponderWrite runs at, zero disables the check
+	MinVoltage float64
 
 	OnStateChange func(state [3]byte)
-	OnError       func(err error)
-	Log           func(str string)
+	// OnError and OnLinkState are called from the engine goroutines, set them through Options
+	OnError     func(err error)
+	OnLinkState func(state kline.LinkState)
+	Log         func(str string)
 
 	rfStatus bool
 }
 
+// sendTimeout is how long a frame may wait for room in the outgoing queue
+const sendTimeout = 1 * time.Second
+
 func New(portName string) (*Client, error) {
-	k, err := kline.New(portName)
-	if err != nil {
-		return nil, err
-	}
+	return NewWithTransport(kline.NewTransport(portName))
+}
 
-	if err := k.Send(message.New(0, []byte{})); err != nil {
-		return nil, err
-	}
+// Options are the client callbacks that have to be in place before its goroutines start
+type Options struct {
+	// OnError replaces the default of logging errors, see Client.OnError
+	OnError func(err error)
+	// OnLinkState is called after the client has brought a reconnected ISM back, see Client.OnLinkState
+	OnLinkState func(state kline.LinkState)
+}
+
+// NewWithTransport creates a client talking through t, such as one end of a kline.NewPipe served by ismsim
+func NewWithTransport(t kline.Transport) (*Client, error) {
+	return NewWithOptions(t, Options{})
+}
 
+// NewWithOptions creates a client talking through t with the callbacks of opts already set
+func NewWithOptions(t kline.Transport, opts Options) (*Client, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	client := &Client{
-		K:                  k,
-		quit:               make(chan struct{}),
-		transmitPacket10:   true,
+		ctx:                ctx,
+		cancel:             cancel,
+		ready:              make(chan struct{}),
 		stateSubscriptions: make(map[*kline.Subscriber]bool),
+		MinVoltage:         DefaultMinVoltage,
 		OnError: func(err error) {
 			log.Println(err)
 		},
+		OnLinkState: opts.OnLinkState,
 	}
-	go client.run()
+	if opts.OnError != nil {
+		client.OnError = opts.OnError
+	}
+	client.codes.reset()
+	k, err := kline.NewWithOptions(t, kline.Options{OnLinkState: client.linkStateChanged})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	client.K = k
+	client.TX = kline.NewTxQueue(k)
+
+	if err := client.send(message.New(0, []byte{})); err != nil {
+		cancel()
+		k.Close()
+		return nil, err
+	}
+	client.packet10 = k.AddPeriodic(message.New(10, []byte{0x00, 0x00, 0x00, 0x00, 0x00}), kline.PeriodicConfig{
+		Period: 200 * time.Millisecond,
+	})
+	client.stateFrame = k.AddPeriodic(nil, kline.PeriodicConfig{
+		MinInterval: 100 * time.Millisecond,
+		Generate:    client.stateMessage,
+		Priority:    kline.PriorityControl,
+	})
+	close(client.ready)
 	go client.handleStateChange()
 
 	return client, nil
 }
 
-func (c *Client) run() {
-	lastState := time.Now()
-	t := time.NewTicker(200 * time.Millisecond)
-	defer t.Stop()
-	for {
-		select {
-		case <-t.C:
-			if c.transmitState && time.Since(lastState) > 100*time.Millisecond {
-				c.transmitState = false
-				if err := c.setState(); err != nil {
-					c.OnError(fmt.Errorf("failed to set state: %w", err))
-				}
-				lastState = time.Now()
-				continue
-			}
-			if c.transmitPacket10 {
-				if err := c.K.Send(message.New(10, []byte{0x00, 0x00, 0x00, 0x00, 0x00})); err != nil {
-					//if err := c.K.Send(generatePacket10()); err != nil {
-					c.OnError(fmt.Errorf("failed to send packet 10: %w", err))
-				}
-			}
-		case <-c.quit:
-			return
+// linkStateChanged brings a reconnected ISM back to where it was, it has lost the init and the lock state
+func (c *Client) linkStateChanged(state kline.LinkState) {
+	// the engine is running before the client is complete
+	select {
+	case <-c.ready:
+	case <-c.ctx.Done():
+		return
+	}
+	if state == kline.LinkUp {
+		c.codes.reset()
+		if err := c.send(message.New(0, []byte{})); err != nil {
+			c.OnError(fmt.Errorf("failed to send init after reconnect: %w", err))
 		}
+		c.stateFrame.Trigger()
+	}
+	if c.OnLinkState != nil {
+		c.OnLinkState(state)
 	}
 }
 
 func (c *Client) Close() error {
-	close(c.quit)
+	c.cancel()
 	return c.K.Close()
 }
 
+// send queues msg, giving up after sendTimeout or when the client is closed
+func (c *Client) send(msg message.Message) error {
+	ctx, cancel := context.WithTimeout(c.ctx, sendTimeout)
+	defer cancel()
+	return c.K.Send(ctx, msg)
+}
+
 func (c *Client) KeyReleased() bool {
 	return c.keyReleased
 }
@@ -107,51 +159,52 @@ func (c *Client) SetLedBrightness(brightness uint8) {
 		brightness = 31
 	}
 	c.ledBrightness = brightness
-	c.transmitState = true
+	c.stateFrame.Trigger()
 }
 
 func (c *Client) LedBrightnessInc() {
 	if c.ledBrightness < 31 {
 		c.ledBrightness++
 	}
-	c.transmitState = true
+	c.stateFrame.Trigger()
 }
 
 func (c *Client) LedBrightnessDec() {
 	if c.ledBrightness > 0 {
 		c.ledBrightness--
 	}
-	c.transmitState = true
+	c.stateFrame.Trigger()
 }
 
 func (c *Client) ReleaseKey() {
 	c.keyReleased = true
-	c.transmitState = true
+	c.stateFrame.Trigger()
 }
 
 func (c *Client) LockKey() {
 	c.keyReleased = false
-	c.transmitState = true
+	c.stateFrame.Trigger()
 }
 
 func (c *Client) Start10() {
-	c.transmitPacket10 = true
+	c.packet10.Resume()
 }
 
 func (c *Client) Stop10() {
-	c.transmitPacket10 = false
+	c.packet10.Pause()
 }
 
 func (c *Client) Toggle10() bool {
-	if !c.transmitPacket10 {
-		codeIndex = []int{-1, -3, -3, -2, -2}
-		if err := c.K.Send(message.New(0, []byte{})); err != nil {
+	if c.packet10.Paused() {
+		c.codes.reset()
+		if err := c.send(message.New(0, []byte{})); err != nil {
 			c.OnError(err)
 		}
-
+		c.packet10.Resume()
+		return true
 	}
-	c.transmitPacket10 = !c.transmitPacket10
-	return c.transmitPacket10
+	c.packet10.Pause()
+	return false
 }
 
 type KeyInfo struct {
@@ -165,56 +218,83 @@ type KeyInfo struct {
 	P7 []byte
 }
 
-func (c *Client) ReadKeyIDE() (*KeyInfo, error) {
-	if err := c.rfON(); err != nil {
-		return nil, err
-	}
-	result := &KeyInfo{}
-	ide, err := c.readIDE()
-	if err != nil {
-		return nil, err
-	}
-
-	if bytes.Equal(ide, []byte{0x1f, 0x40}) {
-		return nil, fmt.Errorf("failed to read key IDE")
-	}
+// ReadKeyIDE opens the radio, reads the transponder IDE and closes the radio again, ctx bounds the whole exchange.
+// Other transponder commands wait until the sequence is done.
+func (c *Client) ReadKeyIDE(ctx context.Context) (*KeyInfo, error) {
+	var result *KeyInfo
+	err := c.TX.Exclusive(ctx, func(ctx context.Context) error {
+		if err := c.rfON(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			if err := c.rfOFF(ctx); err != nil {
+				c.OnError(err)
+			}
+		}()
+		frames, err := c.readIDE(ctx)
+		if err != nil {
+			return err
+		}
 
-	result.P0 = ide[1:]
+		if bytes.Equal(frames[0].Data(), []byte{0x1f, 0x40}) {
+			return fmt.Errorf("failed to read key IDE")
+		}
 
-	if err := c.rfOFF(); err != nil {
-		c.OnError(err)
+		// the IDE frame is followed by the 05 transponder data frames
+		result = &KeyInfo{P0: frames[0].Data()[1:]}
+		for i, f := range frames[1:] {
+			data := f.Data()[1:]
+			switch i {
+			case 0:
+				result.P1 = data
+			case 1:
+				result.P2 = data
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
-
 }
 
-func (c *Client) rfON() error {
-	msg, err := c.K.SendAndRecv(2000*time.Millisecond, message.New(2, []byte{0x03, 0x1f}), 2)
+func (c *Client) rfON(ctx context.Context) error {
+	res, err := c.Transponder(ctx, 0x03, 0x1f)
 	if err != nil {
 		return fmt.Errorf("RFON: %w", err)
 	}
-	if !bytes.Equal(msg.Data(), []byte{0x03, 0x13}) {
-		return fmt.Errorf("RFON: invalid response: %x", msg.Data())
+	// the ISM in addkey.txt answers 0315, others have been seen answering 0313
+	if data := res.Frames[0].Data(); len(data) != 2 || data[0] != 0x03 || (data[1] != 0x13 && data[1] != 0x15) {
+		return fmt.Errorf("RFON: invalid response: %x", data)
 	}
 
 	c.rfStatus = true
 	return nil
 }
 
-func (c *Client) rfOFF() error {
-	if _, err := c.K.SendAndRecv(2000*time.Millisecond, message.New(2, []byte{0x01}), 2); err != nil {
+func (c *Client) rfOFF(ctx context.Context) error {
+	if _, err := c.Transponder(ctx, 0x01); err != nil {
 		return fmt.Errorf("RFOFF: %w", err)
 	}
 	c.rfStatus = false
 	return nil
 }
 
-func (c *Client) readIDE() ([]byte, error) {
-	resp, err := c.K.SendAndRecv(250*time.Millisecond, message.New(2, []byte{0x04}), 2)
+// readIDE returns the frames of the 04 response, the IDE frame and its data frames or a single 1f40 if no key answered
+func (c *Client) readIDE(ctx context.Context) ([]message.Message, error) {
+	res, err := c.Transponder(ctx, 0x04)
+	if len(res.Frames) > 0 && errors.Is(err, context.DeadlineExceeded) {
+		// the ISM does not always send all data frames, keep what arrived
+		err = nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ReadP0: %w", err)
 	}
-	return resp.Data(), nil
+	if res.Frames[0].Data()[0] == 0x05 {
+		return nil, fmt.Errorf("ReadP0: no IDE frame in response")
+	}
+	return res.Frames, nil
 }
 
 const (
@@ -0,0 +1,194 @@
+package ism_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/ism"
+	"github.com/roffe/ismtool/pkg/ismsim"
+	"github.com/roffe/ismtool/pkg/kline"
+)
+
+// newSimClient returns a client talking to a virtual ISM over a pipe, wrap can replace the client end.
+// Errors are logged unless opts has an OnError.
+func newSimClient(t *testing.T, opts ism.Options, wrap ...func(kline.Transport) kline.Transport) (*ism.Client, *ismsim.ISM) {
+	t.Helper()
+	a, b := kline.NewPipe()
+	for _, w := range wrap {
+		a = w(a)
+	}
+	sim := ismsim.New()
+	sim.OnError = func(err error) { t.Log("sim:", err) }
+	quit := make(chan struct{})
+	served := make(chan error, 1)
+	go func() { served <- sim.Serve(b, quit) }()
+
+	if opts.OnError == nil {
+		opts.OnError = func(err error) { t.Log("client:", err) }
+	}
+	c, err := ism.NewWithOptions(a, opts)
+	if err != nil {
+		close(quit)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// stop the sim first, closing the client closes both ends of the pipe
+		close(quit)
+		if err := <-served; err != nil {
+			t.Error("serve:", err)
+		}
+		if err := c.Close(); err != nil {
+			t.Error("close client:", err)
+		}
+	})
+	return c, sim
+}
+
+func TestReadKeyIDE(t *testing.T) {
+	c, sim := newSimClient(t, ism.Options{})
+	sim.Insert(ismsim.DefaultKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ki, err := c.ReadKeyIDE(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ki.P0, ismsim.DefaultKey.IDE[:]) {
+		t.Errorf("IDE %X, want %X", ki.P0, ismsim.DefaultKey.IDE)
+	}
+	if len(ki.P1) == 0 || len(ki.P2) == 0 {
+		t.Errorf("missing transponder data frames: %X %X", ki.P1, ki.P2)
+	}
+}
+
+func TestReadKeyIDENoKey(t *testing.T) {
+	c, sim := newSimClient(t, ism.Options{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.ReadKeyIDE(ctx); err == nil {
+		t.Fatal("read IDE without a key succeeded")
+	}
+	if sim.RFOn() {
+		t.Error("radio left on after a failed read")
+	}
+}
+
+func TestStateChange(t *testing.T) {
+	c, sim := newSimClient(t, ism.Options{})
+	states := make(chan [3]byte, 16)
+	c.OnStateChange = func(state [3]byte) { states <- state }
+	sim.Insert(ismsim.DefaultKey)
+
+	want := sim.State()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state == want {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no state change to %X", want)
+		}
+	}
+}
+
+// supply reports a fixed supply voltage like a J2534 adapter does
+type supply struct {
+	kline.Transport
+	volts float64
+}
+
+func (s *supply) ReadVoltage() (float64, error) {
+	return s.volts, nil
+}
+
+func withSupply(volts float64) func(kline.Transport) kline.Transport {
+	return func(t kline.Transport) kline.Transport {
+		return &supply{Transport: t, volts: volts}
+	}
+}
+
+// key data of the first write in addkey.txt
+var enrolData = []byte{0x85, 0x03, 0xa2, 0x27, 0xa2, 0xe0, 0x21}
+
+func TestEnrolKey(t *testing.T) {
+	c, sim := newSimClient(t, ism.Options{}, withSupply(12.6))
+	sim.Insert(ismsim.DefaultKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.EnrolKey(ctx, enrolData); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Enrolled(); !bytes.Equal(got, enrolData) {
+		t.Errorf("ISM got key data %X, want %X", got, enrolData)
+	}
+}
+
+func TestWritesRefusedOnLowVoltage(t *testing.T) {
+	c, sim := newSimClient(t, ism.Options{}, withSupply(10.8))
+	sim.Insert(ismsim.DefaultKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.EnrolKey(ctx, enrolData); !errors.Is(err, kline.ErrLowVoltage) {
+		t.Errorf("enrol: %v, want %v", err, kline.ErrLowVoltage)
+	}
+	// a write sent as plain transponder command is refused as well
+	if _, err := c.Transponder(ctx, append([]byte{0x08}, enrolData...)...); !errors.Is(err, kline.ErrLowVoltage) {
+		t.Errorf("transponder write: %v, want %v", err, kline.ErrLowVoltage)
+	}
+	if got := sim.Enrolled(); got != nil {
+		t.Errorf("ISM got key data %X", got)
+	}
+	// reads still work
+	if _, err := c.ReadKeyIDE(ctx); err != nil {
+		t.Errorf("read IDE: %v", err)
+	}
+}
+
+// dropout fails one read as if the transport was closed underneath the engine, and can be reopened
+type dropout struct {
+	kline.Transport
+	drop chan struct{}
+}
+
+func (d *dropout) ReadFrame() (kline.Frame, error) {
+	select {
+	case <-d.drop:
+		return kline.Frame{}, kline.ErrTransportClosed
+	default:
+		return d.Transport.ReadFrame()
+	}
+}
+
+// Close leaves the pipe open for the reconnect, the sim is stopped before the client is closed
+func (d *dropout) Close() error { return nil }
+
+func TestLinkStateAfterReconnect(t *testing.T) {
+	states := make(chan kline.LinkState, 8)
+	d := &dropout{drop: make(chan struct{}, 1)}
+	newSimClient(t, ism.Options{OnLinkState: func(s kline.LinkState) { states <- s }}, func(t kline.Transport) kline.Transport {
+		d.Transport = t
+		return d
+	})
+
+	d.drop <- struct{}{}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-states:
+			if s == kline.LinkUp {
+				return
+			}
+		case <-deadline:
+			t.Fatal("link did not come back up")
+		}
+	}
+}
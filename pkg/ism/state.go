@@ -2,7 +2,6 @@ package ism
 
 import (
 	"bytes"
-	"context"
 	"log"
 	"math"
 
@@ -10,7 +9,7 @@ import (
 )
 
 func (c *Client) handleStateChange() {
-	sub, err := c.K.Subscribe(context.TODO(), 14)
+	sub, err := c.K.Subscribe(c.ctx, 14)
 	if err != nil {
 		log.Fatal("failed to subscribe to state change", err)
 	}
@@ -26,7 +25,8 @@ func (c *Client) handleStateChange() {
 
 }
 
-func (c *Client) setState() error {
+// stateMessage builds the id 14 frame with the lock and LED state, it is generated for every send of the state frame
+func (c *Client) stateMessage() message.Message {
 	c.internalState[0] &= 0x03
 	if c.keyReleased {
 		c.internalState[0] |= 0x80
@@ -36,7 +36,7 @@ func (c *Client) setState() error {
 	msg := message.New(14, c.internalState[:])
 
 	//	log.Printf("Sending state: %X", msg.Bytes())
-	return c.K.Send(msg)
+	return msg
 }
 
 type KeyStatus int
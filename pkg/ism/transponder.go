@@ -0,0 +1,114 @@
+package ism
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/kline"
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// transponderTimeout is how long the ISM gets to answer a subcommand, opening and closing the radio is slow
+var transponderTimeout = map[byte]time.Duration{
+	0x01: 2000 * time.Millisecond, // off
+	0x03: 2000 * time.Millisecond, // open
+	0x04: 250 * time.Millisecond,  // request IDE
+}
+
+// transponderWrites are the subcommands that change the transponder or the ISM, the 08 key write of addkey.txt
+var transponderWrites = map[byte]bool{
+	0x08: true,
+}
+
+const defaultTransponderTimeout = 200 * time.Millisecond
+
+// Transponder sends the id 2 request cmd through the transaction queue and returns the response.
+// The reply to a subcommand starts with the same byte, a 04 request IDE is answered with the IDE
+// frame and its 05 data frames, or with 1f40 if no key answered. Write subcommands go through TransponderWrite.
+func (c *Client) Transponder(ctx context.Context, cmd ...byte) (kline.TxResult, error) {
+	if len(cmd) > 0 && transponderWrites[cmd[0]] {
+		return c.TransponderWrite(ctx, cmd...)
+	}
+	return c.TX.Do(ctx, transponderTx(cmd))
+}
+
+// DefaultMinVoltage is the supply voltage below which writes fail half way, a bench supply sagging under
+// the radio load is the most common cause of failed reads and botched writes
+const DefaultMinVoltage = 11.5
+
+// TransponderWrite is Transponder for subcommands that change the transponder or the ISM, such as page writes and key
+// enrolment. It is refused with kline.ErrLowVoltage while the adapter measures a supply voltage below MinVoltage.
+func (c *Client) TransponderWrite(ctx context.Context, cmd ...byte) (kline.TxResult, error) {
+	if err := c.K.CheckVoltage(c.MinVoltage); err != nil {
+		return kline.TxResult{}, fmt.Errorf("transponder write refused: %w", err)
+	}
+	return c.TX.Do(ctx, transponderTx(cmd))
+}
+
+// EnrolKey writes the 7 byte key data to the inserted key the way addkey.txt does: open the radio, read the IDE and
+// status, write with 08 and close the radio. The write is refused like TransponderWrite when the supply is too low.
+func (c *Client) EnrolKey(ctx context.Context, data []byte) error {
+	if len(data) != 7 {
+		return fmt.Errorf("enrol: key data is %d bytes, want 7", len(data))
+	}
+	// checked before the radio is opened, the sequence would otherwise stop half way
+	if err := c.K.CheckVoltage(c.MinVoltage); err != nil {
+		return fmt.Errorf("enrol refused: %w", err)
+	}
+	return c.TX.Exclusive(ctx, func(ctx context.Context) error {
+		if err := c.rfON(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			if err := c.rfOFF(ctx); err != nil {
+				c.OnError(err)
+			}
+		}()
+		frames, err := c.readIDE(ctx)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(frames[0].Data(), []byte{0x1f, 0x40}) {
+			return fmt.Errorf("enrol: no key answered")
+		}
+		if _, err := c.Transponder(ctx, 0x02, 0x06); err != nil {
+			return fmt.Errorf("enrol: read status: %w", err)
+		}
+		if _, err := c.TransponderWrite(ctx, append([]byte{0x08}, data...)...); err != nil {
+			return fmt.Errorf("enrol: %w", err)
+		}
+		return nil
+	})
+}
+
+func transponderTx(cmd []byte) kline.Transaction {
+	tx := kline.Transaction{
+		Request: message.New(2, cmd),
+		Timeout: defaultTransponderTimeout,
+	}
+	if len(cmd) == 0 {
+		tx.Response = kline.Collector{Match: kline.MatchID(2), Done: single}
+		return tx
+	}
+	if t, ok := transponderTimeout[cmd[0]]; ok {
+		tx.Timeout = t
+	}
+	if cmd[0] == 0x04 {
+		tx.Response = kline.Collector{
+			Match: kline.MatchCommand(2, 0x04, 0x05, 0x1f),
+			Done: func(frames []message.Message) bool {
+				return frames[0].Data()[0] == 0x1f || len(frames) == 3
+			},
+			Quiet: kline.DefaultQuiet,
+		}
+		return tx
+	}
+	tx.Response = kline.Collector{Match: kline.MatchCommand(2, cmd[0]), Done: single}
+	return tx
+}
+
+func single(frames []message.Message) bool {
+	return len(frames) == 1
+}
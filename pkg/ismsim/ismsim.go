@@ -0,0 +1,323 @@
+// Package ismsim is a virtual ISM that talks K-line frames over a kline.Transport
+package ismsim
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/kline"
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+var (
+	ErrNoKey     = errors.New("no key inserted")
+	ErrKeyLocked = errors.New("key is locked")
+)
+
+// Position is the physical position of the virtual key
+type Position int
+
+const (
+	NotInserted Position = iota
+	HalfInserted
+	Blocked
+	Inserted
+	ON
+	START
+)
+
+func (p Position) String() string {
+	switch p {
+	case NotInserted:
+		return "Not Inserted"
+	case HalfInserted:
+		return "Half Inserted"
+	case Blocked:
+		return "Blocked"
+	case Inserted:
+		return "Inserted"
+	case ON:
+		return "ON"
+	case START:
+		return "START"
+	default:
+		return "Unknown"
+	}
+}
+
+// state frames as reported by the ISM, they match the key position masks used by ism.Client
+var positionState = map[Position][3]byte{
+	NotInserted:  {0x91, 0x69, 0x2b},
+	HalfInserted: {0x91, 0x68, 0x6b},
+	Blocked:      {0x19, 0xe0, 0x6b},
+	Inserted:     {0x99, 0x60, 0x6b},
+	ON:           {0xb1, 0x48, 0x6b},
+	START:        {0xf1, 0x08, 0x6b},
+}
+
+// Key is a virtual key with its transponder
+type Key struct {
+	// IDE is the transponder identifier returned in the first frame of a 04 request
+	IDE [4]byte
+}
+
+// DefaultKey is the key seen in addkey.txt
+var DefaultKey = Key{IDE: [4]byte{0x38, 0xfe, 0xc1, 0x34}}
+
+type ISM struct {
+	mu sync.Mutex
+
+	key      *Key
+	position Position
+	released bool
+	led      uint8
+	rfOn     bool
+	enrolled []byte // key data of the last 08 write
+
+	// StatePeriod is how often the 3 byte id 14 state frame is sent
+	StatePeriod time.Duration
+	// OpenStatus is the second byte of the answer to the 031f radio open command
+	OpenStatus byte
+	// Echo writes every received frame back like a single-wire K-line does
+	Echo bool
+
+	OnError func(err error)
+	// Log is called with every frame received from the host when set
+	Log func(msg message.Message)
+}
+
+func New() *ISM {
+	return &ISM{
+		StatePeriod: 100 * time.Millisecond,
+		OpenStatus:  0x15,
+		OnError: func(err error) {
+			log.Println(err)
+		},
+	}
+}
+
+// Serve answers frames on t until quit is closed or t fails, it returns once both its goroutines have stopped
+func (s *ISM) Serve(t kline.Transport, quit <-chan struct{}) error {
+	stop := make(chan struct{})
+	var once sync.Once
+	var err error
+	halt := func(e error) {
+		once.Do(func() {
+			err = e
+			close(stop)
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		halt(s.reader(t, stop))
+	}()
+	go func() {
+		defer wg.Done()
+		halt(s.stateSender(t, stop))
+	}()
+	select {
+	case <-quit:
+		halt(nil)
+	case <-stop:
+	}
+	wg.Wait()
+	return err
+}
+
+func (s *ISM) reader(t kline.Transport, quit <-chan struct{}) error {
+	for {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		frame, err := t.ReadFrame()
+		if err != nil {
+			if errors.Is(err, kline.ErrTransportClosed) || errors.Is(err, kline.ErrLinkDown) {
+				return err
+			}
+			s.OnError(err)
+		}
+		if len(frame.Data) == 0 {
+			continue
+		}
+		if s.Echo {
+			if err := t.WriteFrame(frame.Data); err != nil {
+				return err
+			}
+		}
+		msg, err := message.NewFromBytes(frame.Data)
+		if err != nil {
+			s.OnError(err)
+			continue
+		}
+		if s.Log != nil {
+			s.Log(msg)
+		}
+		for _, resp := range s.handle(msg) {
+			if err := t.WriteFrame(resp.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *ISM) stateSender(t kline.Transport, quit <-chan struct{}) error {
+	ticker := time.NewTicker(s.StatePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+			state := s.State()
+			if err := t.WriteFrame(message.New(14, state[:]).Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle returns the frames the ISM answers msg with
+func (s *ISM) handle(msg message.Message) []message.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch msg.ID() {
+	case 0:
+		return []message.Message{message.New(0, []byte{})}
+	case 10:
+		return nil
+	case 14:
+		if data := msg.Data(); len(data) == 2 {
+			s.released = data[0]&0x80 != 0
+			s.led = (data[0] & 0x7c) >> 2
+			if s.released && s.position == Blocked {
+				s.position = Inserted
+			}
+		}
+		return nil
+	case 2:
+		return s.transponder(msg.Data())
+	}
+	return nil
+}
+
+func (s *ISM) transponder(data []byte) []message.Message {
+	switch {
+	case bytes.Equal(data, []byte{0x03, 0x1f}): // open
+		s.rfOn = true
+		return []message.Message{message.New(2, []byte{0x03, s.OpenStatus})}
+	case bytes.Equal(data, []byte{0x04}): // request IDE
+		if !s.rfOn || s.key == nil {
+			return []message.Message{message.New(2, []byte{0x1f, 0x40})}
+		}
+		return []message.Message{
+			message.New(2, append([]byte{0x04}, s.key.IDE[:]...)),
+			message.New(2, []byte{0x05, 0x3f, 0x2e, 0x31, 0x31, 0x69, 0xd4, 0x44, 0xb1}),
+			message.New(2, []byte{0x05, 0xf6, 0xb4, 0xbb, 0x71}),
+		}
+	case bytes.Equal(data, []byte{0x02, 0x06}): // read status
+		return []message.Message{message.New(2, []byte{0x02, 0x00})}
+	case len(data) == 8 && data[0] == 0x08: // write key data
+		if !s.rfOn || s.key == nil {
+			return []message.Message{message.New(2, []byte{0x1f, 0x40})}
+		}
+		s.enrolled = append([]byte(nil), data[1:]...)
+		return []message.Message{message.New(2, []byte{0x08})}
+	case bytes.Equal(data, []byte{0x01}): // off
+		s.rfOn = false
+		return []message.Message{message.New(2, []byte{0x01})}
+	}
+	return nil
+}
+
+// State returns the 3 byte state frame for the current key position
+func (s *ISM) State() [3]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return positionState[s.position]
+}
+
+func (s *ISM) Position() Position {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position
+}
+
+// Released reports if the host has released the key lock
+func (s *ISM) Released() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.released
+}
+
+// Enrolled returns the key data the host last wrote with 08, nil if there was no write
+func (s *ISM) Enrolled() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enrolled
+}
+
+// RFOn reports if the host left the transponder radio on
+func (s *ISM) RFOn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rfOn
+}
+
+// LedBrightness returns the brightness last set by the host
+func (s *ISM) LedBrightness() uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.led
+}
+
+func (s *ISM) HalfInsert(k Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = &k
+	s.position = HalfInserted
+}
+
+func (s *ISM) Insert(k Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = &k
+	s.position = Inserted
+}
+
+// TurnOn turns the key to ON, a locked key ends up Blocked
+func (s *ISM) TurnOn() error {
+	return s.turn(ON)
+}
+
+// TurnStart turns the key to START, a locked key ends up Blocked
+func (s *ISM) TurnStart() error {
+	return s.turn(START)
+}
+
+func (s *ISM) turn(pos Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == nil || s.position == HalfInserted {
+		return ErrNoKey
+	}
+	if !s.released {
+		s.position = Blocked
+		return ErrKeyLocked
+	}
+	s.position = pos
+	return nil
+}
+
+func (s *ISM) Remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = nil
+	s.position = NotInserted
+}
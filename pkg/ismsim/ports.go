@@ -0,0 +1,24 @@
+package ismsim
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LinkName is where a running simulator links its pseudo-terminal so it can be found by Ports
+var LinkName = filepath.Join(os.TempDir(), "ismsim")
+
+// Ports returns the pseudo-terminals of running simulators
+func Ports() []string {
+	matches, err := filepath.Glob(LinkName + "*")
+	if err != nil {
+		return nil
+	}
+	var ports []string
+	for _, m := range matches {
+		if _, err := os.Stat(m); err == nil {
+			ports = append(ports, m)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package ismsim
+
+import (
+	"errors"
+	"os"
+)
+
+type PTY struct {
+	Master *os.File
+	Name   string
+}
+
+func OpenPTY() (*PTY, error) {
+	return nil, errors.New("pseudo-terminals are only supported on linux")
+}
+
+func (p *PTY) Close() error {
+	return nil
+}
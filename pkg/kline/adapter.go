@@ -0,0 +1,227 @@
+package kline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adapter types
+const (
+	AdapterJ2534  = "j2534"
+	AdapterSerial = "serial"
+	AdapterTCP    = "tcp"
+)
+
+var ErrUnknownAdapter = errors.New("unknown adapter")
+
+// Adapter is a named interface definition, read from the adapter config file or found installed on the system
+type Adapter struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Library is the J2534 DLL path
+	Library string `json:"library,omitempty"`
+	// Port is the serial port name or the host:port of a TCP endpoint
+	Port string `json:"port,omitempty"`
+	// Protocol, Baud and Flags are passed to PassThruConnect, zero values use DefaultJ2534Config
+	Protocol uint32 `json:"protocol,omitempty"`
+	Baud     uint32 `json:"baud,omitempty"`
+	Flags    uint32 `json:"flags,omitempty"`
+	// Loopback has a J2534 adapter confirm transmissions, see J2534Config
+	Loopback bool `json:"loopback,omitempty"`
+	// EchoWindow is how long the echo of a written frame may take, such as "300ms", empty for the transport default
+	EchoWindow string `json:"echo_window,omitempty"`
+	// Installed is set for J2534 adapters found in the PassThruSupport registry key
+	Installed bool `json:"-"`
+}
+
+func (a Adapter) String() string {
+	switch a.Type {
+	case AdapterJ2534:
+		return fmt.Sprintf("%s (J2534 %s)", a.Name, a.Library)
+	case AdapterTCP:
+		return fmt.Sprintf("%s (%s%s)", a.Name, TCPScheme, a.Port)
+	default:
+		return fmt.Sprintf("%s (%s)", a.Name, a.Port)
+	}
+}
+
+// Transport returns the transport for the adapter
+func (a Adapter) Transport() (Transport, error) {
+	window, err := a.echoWindow()
+	if err != nil {
+		return nil, err
+	}
+	switch a.Type {
+	case AdapterJ2534:
+		cfg := DefaultJ2534Config
+		if a.Library != "" {
+			cfg.Library = a.Library
+		}
+		if a.Protocol != 0 {
+			cfg.Protocol = a.Protocol
+		}
+		if a.Baud != 0 {
+			cfg.BaudRate = a.Baud
+		}
+		if a.Flags != 0 {
+			cfg.Flags = a.Flags
+		}
+		if a.Loopback {
+			cfg.Loopback = true
+		}
+		if window != 0 {
+			cfg.EchoWindow = window
+		}
+		return NewJ2534Transport(cfg), nil
+	case AdapterSerial:
+		if a.Port == "" {
+			return nil, fmt.Errorf("adapter %q: no port", a.Name)
+		}
+		cfg := DefaultStreamConfig
+		if window != 0 {
+			cfg.EchoWindow = window
+		}
+		return NewSerialTransport(a.Port, cfg), nil
+	case AdapterTCP:
+		if a.Port == "" {
+			return nil, fmt.Errorf("adapter %q: no port", a.Name)
+		}
+		cfg := DefaultTCPStreamConfig
+		if window != 0 {
+			cfg.EchoWindow = window
+		}
+		return NewTCPTransport(strings.TrimPrefix(a.Port, TCPScheme), cfg), nil
+	default:
+		return nil, fmt.Errorf("adapter %q: unknown type %q", a.Name, a.Type)
+	}
+}
+
+func (a Adapter) echoWindow() (time.Duration, error) {
+	if a.EchoWindow == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(a.EchoWindow)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("adapter %q: invalid echo window %q", a.Name, a.EchoWindow)
+	}
+	return d, nil
+}
+
+// DefaultAdapters are always in a registry, config file entries with the same name replace them.
+// J2534 adapters are only among them on windows, elsewhere they can not be opened.
+var DefaultAdapters = defaultJ2534Adapters
+
+// AdapterConfig is the layout of the adapter config file
+type AdapterConfig struct {
+	Adapters []Adapter `json:"adapters"`
+}
+
+// DefaultAdapterConfigPath returns adapters.json in the ismtool user config directory
+func DefaultAdapterConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "adapters.json"
+	}
+	return filepath.Join(dir, "ismtool", "adapters.json")
+}
+
+// Registry holds the adapters that can be selected by name
+type Registry struct {
+	adapters map[string]Adapter
+}
+
+// NewRegistry returns a registry with DefaultAdapters and the J2534 adapters installed on the system
+func NewRegistry() *Registry {
+	r := &Registry{adapters: make(map[string]Adapter)}
+	for _, a := range DefaultAdapters {
+		r.Add(a)
+	}
+	for _, a := range installedJ2534() {
+		r.Add(a)
+	}
+	return r
+}
+
+// LoadRegistry returns NewRegistry with the adapters of the config file at path added, a missing file is not an error
+func LoadRegistry(path string) (*Registry, error) {
+	r := NewRegistry()
+	if path == "" {
+		return r, nil
+	}
+	if err := r.Load(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return r, err
+	}
+	return r, nil
+}
+
+// Load adds the adapters of the config file at path
+func (r *Registry) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg AdapterConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("adapter config %s: %w", path, err)
+	}
+	for _, a := range cfg.Adapters {
+		if err := r.Add(a); err != nil {
+			return fmt.Errorf("adapter config %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Add adds a or replaces the adapter with the same name
+func (r *Registry) Add(a Adapter) error {
+	if a.Name == "" {
+		return errors.New("adapter without name")
+	}
+	a.Type = strings.ToLower(a.Type)
+	switch a.Type {
+	case AdapterJ2534, AdapterSerial, AdapterTCP:
+	default:
+		return fmt.Errorf("adapter %q: unknown type %q", a.Name, a.Type)
+	}
+	if _, err := a.echoWindow(); err != nil {
+		return err
+	}
+	r.adapters[strings.ToLower(a.Name)] = a
+	return nil
+}
+
+// Get returns the adapter called name, names are not case sensitive
+func (r *Registry) Get(name string) (Adapter, error) {
+	a, ok := r.adapters[strings.ToLower(name)]
+	if !ok {
+		return Adapter{}, fmt.Errorf("%w: %s", ErrUnknownAdapter, name)
+	}
+	return a, nil
+}
+
+// List returns every adapter sorted by name
+func (r *Registry) List() []Adapter {
+	out := make([]Adapter, 0, len(r.adapters))
+	for _, a := range r.adapters {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name)
+	})
+	return out
+}
+
+// Transport returns the transport of the adapter called name
+func (r *Registry) Transport(name string) (Transport, error) {
+	a, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Transport()
+}
@@ -0,0 +1,95 @@
+package kline
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "adapters.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRegistry(t *testing.T) {
+	path := writeConfig(t, `{"adapters": [
+		{"name": "garage", "type": "tcp", "port": "tcp://garage:4001", "echo_window": "300ms"},
+		{"name": "cable", "type": "SERIAL", "port": "/dev/ttyUSB0"}
+	]}`)
+	r, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := r.Get("Garage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := a.Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := tr.Capabilities().EchoWindow; w.Milliseconds() != 300 {
+		t.Errorf("echo window %s, want 300ms", w)
+	}
+	if a, err := r.Get("cable"); err != nil || a.Type != AdapterSerial {
+		t.Errorf("cable: %+v %v", a, err)
+	}
+}
+
+func TestAdapterLoopback(t *testing.T) {
+	for _, loopback := range []bool{false, true} {
+		a := Adapter{Name: "mongoose", Type: AdapterJ2534, Loopback: loopback}
+		tr, err := a.Transport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if echo := tr.Capabilities().Echo; echo != loopback {
+			t.Errorf("loopback %v: transport echo %v", loopback, echo)
+		}
+	}
+	if DefaultJ2534Config.Loopback {
+		t.Error("DefaultJ2534Config changed")
+	}
+}
+
+func TestLoadRegistryMissingFile(t *testing.T) {
+	r, err := LoadRegistry(filepath.Join(t.TempDir(), "adapters.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.List()) != len(DefaultAdapters)+len(installedJ2534()) {
+		t.Errorf("adapters %v", r.List())
+	}
+}
+
+func TestLoadRegistryMalformed(t *testing.T) {
+	for name, content := range map[string]string{
+		"syntax":      `{"adapters": [`,
+		"type":        `{"adapters": [{"name": "x", "type": "can"}]}`,
+		"echo window": `{"adapters": [{"name": "x", "type": "tcp", "port": "h:1", "echo_window": "soon"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, err := LoadRegistry(writeConfig(t, content))
+			if err == nil {
+				t.Fatal("malformed config loaded")
+			}
+			// the ports and adapters that do not depend on the file are still there
+			if r == nil || len(r.List()) != len(DefaultAdapters)+len(installedJ2534()) {
+				t.Errorf("registry %v", r)
+			}
+		})
+	}
+}
+
+func TestDefaultAdapters(t *testing.T) {
+	for _, a := range DefaultAdapters {
+		if a.Type == AdapterJ2534 && runtime.GOOS != "windows" {
+			t.Errorf("J2534 adapter %s offered on %s", a, runtime.GOOS)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package kline
+
+import (
+	"context"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// DefaultQuiet is the gap after the last frame that ends a multi-frame response,
+// the ISM sends the frames of one response some 30-50ms apart
+const DefaultQuiet = 100 * time.Millisecond
+
+// Collector describes a response that spans several frames
+type Collector struct {
+	// Match selects the frames that belong to the response
+	Match Matcher
+	// Done is called with the frames collected so far and returns true once the response is complete, it may be nil
+	Done func(frames []message.Message) bool
+	// Quiet ends the response when no matching frame arrived for this long after the first one, zero waits for Done or ctx
+	Quiet time.Duration
+}
+
+// SendAndCollect sends msg and returns every frame c matches, in the order received, until c.Done reports the
+// response complete or the line has been quiet for c.Quiet. If ctx ends first the frames so far are returned with the ctx error.
+func (e *Engine) SendAndCollect(ctx context.Context, msg message.Message, c Collector) ([]message.Message, error) {
+	sub, err := e.SubscribeFunc(ctx, c.Match)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	written, err := e.sendTracked(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []message.Message
+	var quiet <-chan time.Time
+	var t *time.Timer
+	defer func() {
+		if t != nil {
+			t.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return frames, ctx.Err()
+		case <-quiet:
+			return frames, nil
+		case m, ok := <-sub.Chan():
+			if !ok {
+				if err := sub.Err(); err != nil {
+					return frames, err
+				}
+				return frames, ErrSubscriberClosed
+			}
+			if len(frames) == 0 {
+				e.observeResponse(ctx, msg, m, written)
+			}
+			frames = append(frames, m)
+			if c.Done != nil && c.Done(frames) {
+				return frames, nil
+			}
+			if c.Quiet > 0 {
+				if t == nil {
+					t = time.NewTimer(c.Quiet)
+					quiet = t.C
+				} else {
+					if !t.Stop() {
+						<-t.C
+					}
+					t.Reset(c.Quiet)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package kline
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// maxFrameSize is header, 15 data bytes and checksum
+const maxFrameSize = 17
+
+// Decoder splits a raw K-line byte stream into frames.
+//
+// The low nibble of the header byte is the data length and, unless Checksum is ChecksumNone on the receive side,
+// the frame ends with an additive checksum over header and data. A frame failing a verified checksum is dropped
+// one byte at a time until the decoder is back in sync, which counts as one bad frame, and a gap longer than InterByteTimeout discards whatever partial frame is pending since the next byte has to be a new header.
+type Decoder struct {
+	InterByteTimeout time.Duration
+	Checksum         message.Checksum
+
+	buf    []byte
+	last   time.Time
+	resync bool // bytes are being dropped until a frame decodes again
+
+	frames, badFrames, skipped uint64
+}
+
+type DecoderStats struct {
+	Frames       uint64 // frames decoded
+	BadFrames    uint64 // checksum failures, one per resynchronisation, and partial frames cut off by the inter-byte timeout
+	SkippedBytes uint64 // bytes thrown away while resynchronising
+}
+
+func NewDecoder(interByteTimeout time.Duration, checksum message.Checksum) *Decoder {
+	return &Decoder{
+		InterByteTimeout: interByteTimeout,
+		Checksum:         checksum,
+		buf:              make([]byte, 0, maxFrameSize*4),
+	}
+}
+
+// Feed appends bytes that were read at now
+func (d *Decoder) Feed(now time.Time, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if len(d.buf) > 0 && d.InterByteTimeout > 0 && now.Sub(d.last) > d.InterByteTimeout {
+		if !d.resync {
+			atomic.AddUint64(&d.badFrames, 1)
+		}
+		atomic.AddUint64(&d.skipped, uint64(len(d.buf)))
+		d.buf = d.buf[:0]
+		d.resync = false
+	}
+	d.buf = append(d.buf, p...)
+	d.last = now
+}
+
+// Next returns the next complete frame with the checksum stripped, or nil if more bytes are needed.
+// An error without frame means a bad frame was found, call Next again to continue decoding. The bytes skipped
+// while resynchronising after it are dropped without further errors.
+// With ChecksumLogOnly a mismatching frame is returned together with its *message.ChecksumError.
+func (d *Decoder) Next() ([]byte, error) {
+	for len(d.buf) > 0 {
+		size := getPacketSize(d.buf[0])
+		if d.Checksum.Received() {
+			size++
+		}
+		if len(d.buf) < size {
+			return nil, nil
+		}
+		raw := make([]byte, size)
+		copy(raw, d.buf[:size])
+
+		frame, err := d.Checksum.Decode(raw)
+		if frame == nil {
+			// drop the first byte and try to find the start of the next frame
+			d.buf = d.buf[:copy(d.buf, d.buf[1:])]
+			atomic.AddUint64(&d.skipped, 1)
+			if d.resync {
+				continue
+			}
+			d.resync = true
+			atomic.AddUint64(&d.badFrames, 1)
+			return nil, err
+		}
+		d.resync = false
+		if err != nil {
+			atomic.AddUint64(&d.badFrames, 1)
+		}
+
+		d.buf = d.buf[:copy(d.buf, d.buf[size:])]
+		atomic.AddUint64(&d.frames, 1)
+		return frame, err
+	}
+	return nil, nil
+}
+
+// Pending returns the number of buffered bytes not yet decoded
+func (d *Decoder) Pending() int {
+	return len(d.buf)
+}
+
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.resync = false
+}
+
+func (d *Decoder) Stats() DecoderStats {
+	return DecoderStats{
+		Frames:       atomic.LoadUint64(&d.frames),
+		BadFrames:    atomic.LoadUint64(&d.badFrames),
+		SkippedBytes: atomic.LoadUint64(&d.skipped),
+	}
+}
@@ -0,0 +1,131 @@
+package kline
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+func TestDecoder(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	// id 2 with 0315 and its checksum
+	good := []byte{0x22, 0x03, 0x15, 0x3a}
+
+	type chunk struct {
+		after time.Duration // since the previous chunk
+		data  []byte
+	}
+	tests := []struct {
+		name     string
+		checksum message.Checksum
+		chunks   []chunk
+		frames   [][]byte
+		errors   int
+		stats    DecoderStats
+	}{
+		{
+			name:     "good frame",
+			checksum: message.ChecksumVerify,
+			chunks:   []chunk{{0, good}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}},
+			stats:    DecoderStats{Frames: 1},
+		},
+		{
+			name:     "good frame split",
+			checksum: message.ChecksumVerify,
+			chunks:   []chunk{{0, good[:2]}, {time.Millisecond, good[2:]}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}},
+			stats:    DecoderStats{Frames: 1},
+		},
+		{
+			name:     "bad checksum",
+			checksum: message.ChecksumVerify,
+			// the rest of the bad frame is dropped by the gap before the next one
+			chunks: []chunk{{0, []byte{0x22, 0x03, 0x15, 0x3b}}, {2 * timeout, good}},
+			frames: [][]byte{{0x22, 0x03, 0x15}},
+			errors: 1,
+			stats:  DecoderStats{Frames: 1, BadFrames: 1, SkippedBytes: 4},
+		},
+		{
+			name:     "bad checksum log only",
+			checksum: message.ChecksumLogOnly,
+			chunks:   []chunk{{0, []byte{0x22, 0x03, 0x15, 0x3b}}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}},
+			errors:   1,
+			stats:    DecoderStats{Frames: 1, BadFrames: 1},
+		},
+		{
+			name:     "truncated frame",
+			checksum: message.ChecksumVerify,
+			chunks:   []chunk{{0, good[:2]}, {2 * timeout, good}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}},
+			stats:    DecoderStats{Frames: 1, BadFrames: 1, SkippedBytes: 2},
+		},
+		{
+			name:     "resync after garbage",
+			checksum: message.ChecksumVerify,
+			chunks:   []chunk{{0, append([]byte{0x11, 0x01}, good...)}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}},
+			errors:   1,
+			stats:    DecoderStats{Frames: 1, BadFrames: 1, SkippedBytes: 2},
+		},
+		{
+			name:     "resync across reads",
+			checksum: message.ChecksumVerify,
+			chunks:   []chunk{{0, []byte{0x11, 0x01, 0x22}}, {time.Millisecond, good[1:]}, {time.Millisecond, good}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}, {0x22, 0x03, 0x15}},
+			errors:   1,
+			stats:    DecoderStats{Frames: 2, BadFrames: 1, SkippedBytes: 2},
+		},
+		{
+			name:     "no checksum",
+			checksum: message.ChecksumNone,
+			chunks:   []chunk{{0, []byte{0x22, 0x03, 0x15, 0x10}}},
+			frames:   [][]byte{{0x22, 0x03, 0x15}, {0x10}},
+			stats:    DecoderStats{Frames: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(timeout, tt.checksum)
+			now := time.Now()
+			var frames [][]byte
+			errors := 0
+			for _, c := range tt.chunks {
+				now = now.Add(c.after)
+				d.Feed(now, c.data)
+				for {
+					frame, err := d.Next()
+					if err != nil {
+						errors++
+					}
+					if frame != nil {
+						frames = append(frames, frame)
+					}
+					if frame == nil && err == nil {
+						break
+					}
+				}
+			}
+			if len(frames) != len(tt.frames) {
+				t.Fatalf("frames %X, want %X", frames, tt.frames)
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], tt.frames[i]) {
+					t.Errorf("frame %d %X, want %X", i, frames[i], tt.frames[i])
+				}
+			}
+			if errors != tt.errors {
+				t.Errorf("%d errors, want %d", errors, tt.errors)
+			}
+			if st := d.Stats(); st != tt.stats {
+				t.Errorf("stats %+v, want %+v", st, tt.stats)
+			}
+			if d.Pending() != 0 {
+				t.Errorf("%d bytes pending", d.Pending())
+			}
+		})
+	}
+}
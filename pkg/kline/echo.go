@@ -0,0 +1,129 @@
+package kline
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPossibleCollision = errors.New("possible bus collision")
+	// ErrLateEcho is reported for an echo that arrived after its frame was already reported as unconfirmed
+	ErrLateEcho = errors.New("late echo")
+)
+
+var (
+	// DefaultEchoWindow is how long after writing a frame its echo is expected back on a local line,
+	// transports with more latency report their own window in Capabilities
+	DefaultEchoWindow = 100 * time.Millisecond
+	// DefaultTCPEchoWindow is the echo window of TCP transports whose StreamConfig does not set one
+	DefaultTCPEchoWindow = 500 * time.Millisecond
+)
+
+// lateEchoWindows is how many echo windows after the write a late echo is still recognised and dropped
+const lateEchoWindows = 4
+
+// echoFilter matches frames read back on a single-wire K-line against what was just written
+type echoFilter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending []sentFrame
+	late    []sentFrame // expired without echo, an echo arriving for them now must not pass as a received frame
+}
+
+type sentFrame struct {
+	data []byte
+	tx   *TxMsg
+}
+
+func newEchoFilter(window time.Duration) *echoFilter {
+	if window <= 0 {
+		window = DefaultEchoWindow
+	}
+	return &echoFilter{window: window}
+}
+
+// sent records tx, written at tx.Written
+func (f *echoFilter) sent(tx *TxMsg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, sentFrame{data: tx.Bytes(), tx: tx})
+}
+
+// match returns the pending outgoing message frame read at t is the echo of, or nil.
+// Messages sent before the matched one never came back and are returned as unmatched.
+func (f *echoFilter) match(frame []byte, t time.Time) (echo *TxMsg, unmatched []*TxMsg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, p := range f.pending {
+		if t.Sub(p.tx.Written) > f.window || !bytes.Equal(p.data, frame) {
+			continue
+		}
+		for _, u := range f.pending[:i] {
+			unmatched = append(unmatched, u.tx)
+		}
+		f.pending = f.pending[i+1:]
+		return p.tx, unmatched
+	}
+	return nil, nil
+}
+
+// expire removes and returns messages whose echo did not arrive within the window
+func (f *echoFilter) expire(now time.Time) (unmatched []*TxMsg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, p := range f.pending {
+		if now.Sub(p.tx.Written) <= f.window {
+			break
+		}
+		unmatched = append(unmatched, p.tx)
+		n++
+	}
+	f.late = append(f.late, f.pending[:n]...)
+	f.pending = f.pending[n:]
+
+	n = 0
+	for _, p := range f.late {
+		if now.Sub(p.tx.Written) <= lateEchoWindows*f.window {
+			break
+		}
+		n++
+	}
+	f.late = f.late[n:]
+	return unmatched
+}
+
+// lateEcho removes and returns the expired message frame read at t is the echo of, or nil
+func (f *echoFilter) lateEcho(frame []byte, t time.Time) *TxMsg {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, p := range f.late {
+		if t.Sub(p.tx.Written) > lateEchoWindows*f.window || !bytes.Equal(p.data, frame) {
+			continue
+		}
+		f.late = append(f.late[:i], f.late[i+1:]...)
+		return p.tx
+	}
+	return nil
+}
+
+// forget removes tx, used when the write failed and no echo will come
+func (f *echoFilter) forget(tx *TxMsg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.pending) - 1; i >= 0; i-- {
+		if f.pending[i].tx == tx {
+			f.pending = append(f.pending[:i], f.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *echoFilter) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = nil
+	f.late = nil
+}
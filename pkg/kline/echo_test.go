@@ -0,0 +1,211 @@
+package kline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+func TestEchoFilterMatch(t *testing.T) {
+	t0 := time.Now()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	msgs := []message.Message{
+		message.New(2, []byte{0x03, 0x1f}),
+		message.New(2, []byte{0x04}),
+		message.New(14, []byte{0x01}),
+	}
+	type read struct {
+		msg       int // index in msgs of the frame read
+		at        int // ms after t0
+		echo      int // index in msgs of the echo matched, -1 for none
+		unmatched []int
+	}
+	tests := []struct {
+		name  string
+		sent  []int // indexes in msgs, written at t0
+		reads []read
+	}{
+		{"in order", []int{0, 1}, []read{{0, 10, 0, nil}, {1, 20, 1, nil}}},
+		{"out of order", []int{0, 1}, []read{{1, 10, 1, []int{0}}, {0, 20, -1, nil}}},
+		{"skips to the echo", []int{0, 1, 2}, []read{{2, 10, 2, []int{0, 1}}}},
+		{"outside window", []int{0}, []read{{0, 150, -1, nil}}},
+		{"other frame", []int{0}, []read{{2, 10, -1, nil}, {0, 20, 0, nil}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newEchoFilter(100 * time.Millisecond)
+			txs := make(map[*TxMsg]int)
+			for _, i := range tt.sent {
+				tx := &TxMsg{Message: msgs[i], Written: t0}
+				txs[tx] = i
+				f.sent(tx)
+			}
+			for _, r := range tt.reads {
+				echo, unmatched := f.match(msgs[r.msg].Bytes(), at(r.at))
+				got := -1
+				if echo != nil {
+					got = txs[echo]
+				}
+				if got != r.echo {
+					t.Errorf("frame %X at %dms matched %d, want %d", msgs[r.msg].Bytes(), r.at, got, r.echo)
+				}
+				var gotUnmatched []int
+				for _, u := range unmatched {
+					gotUnmatched = append(gotUnmatched, txs[u])
+				}
+				if len(gotUnmatched) != len(r.unmatched) {
+					t.Errorf("frame %X at %dms unmatched %v, want %v", msgs[r.msg].Bytes(), r.at, gotUnmatched, r.unmatched)
+					continue
+				}
+				for i := range gotUnmatched {
+					if gotUnmatched[i] != r.unmatched[i] {
+						t.Errorf("frame %X at %dms unmatched %v, want %v", msgs[r.msg].Bytes(), r.at, gotUnmatched, r.unmatched)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEchoFilterExpire(t *testing.T) {
+	t0 := time.Now()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	f := newEchoFilter(100 * time.Millisecond)
+	a := &TxMsg{Message: message.New(2, []byte{0x03, 0x1f}), Written: at(0)}
+	b := &TxMsg{Message: message.New(2, []byte{0x04}), Written: at(80)}
+	f.sent(a)
+	f.sent(b)
+
+	if unmatched := f.expire(at(50)); len(unmatched) != 0 {
+		t.Errorf("expired %d within the window", len(unmatched))
+	}
+	if unmatched := f.expire(at(150)); len(unmatched) != 1 || unmatched[0] != a {
+		t.Fatalf("expired %v at 150ms, want only the first frame", unmatched)
+	}
+	// the second frame is still in its window, its echo is a match and not late
+	if tx := f.lateEcho(b.Bytes(), at(160)); tx != nil {
+		t.Errorf("pending frame returned as late echo")
+	}
+	if tx := f.lateEcho(a.Bytes(), at(160)); tx != a {
+		t.Errorf("late echo returned %v, want the expired frame", tx)
+	}
+	if tx := f.lateEcho(a.Bytes(), at(170)); tx != nil {
+		t.Errorf("late echo returned twice")
+	}
+
+	if unmatched := f.expire(at(300)); len(unmatched) != 1 || unmatched[0] != b {
+		t.Fatalf("expired %v at 300ms, want only the second frame", unmatched)
+	}
+	if tx := f.lateEcho(b.Bytes(), at(490)); tx != nil {
+		t.Errorf("echo %s after the write returned as late echo, it is only recognised for %d windows", 410*time.Millisecond, lateEchoWindows)
+	}
+	f.expire(at(500))
+	if len(f.late) != 0 || len(f.pending) != 0 {
+		t.Errorf("%d late and %d pending frames left", len(f.late), len(f.pending))
+	}
+}
+
+// echoPipe is a pipe end on a line that reads back what it writes, the other end decides which frames come back
+type echoPipe struct {
+	Transport
+	window time.Duration
+}
+
+func (p *echoPipe) Capabilities() Capabilities {
+	return Capabilities{Name: "echo pipe", Echo: true, EchoWindow: p.window}
+}
+
+func TestEchoStatus(t *testing.T) {
+	a, b := NewPipe()
+	defer b.Close()
+	errs := make(chan error, 10)
+	e, err := NewWithOptions(&echoPipe{Transport: a, window: 50 * time.Millisecond}, Options{
+		OnError: func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	outgoing := make(chan *TxMsg, 10)
+	e.OnOutgoing = func(msg message.Message) { outgoing <- msg.(*TxMsg) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := e.Subscribe(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	sendAndRead := func(msg message.Message) []byte {
+		t.Helper()
+		if err := e.Send(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := b.ReadFrame()
+		for err == nil && len(frame.Data) == 0 {
+			frame, err = b.ReadFrame()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame.Data
+	}
+	status := func() *TxMsg {
+		t.Helper()
+		select {
+		case tx := <-outgoing:
+			return tx
+		case <-ctx.Done():
+			t.Fatal("OnOutgoing not called")
+			return nil
+		}
+	}
+
+	// read back in time
+	frame := sendAndRead(message.New(2, []byte{0x03, 0x1f}))
+	if err := b.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if tx := status(); tx.Status != TxConfirmed {
+		t.Errorf("echoed frame %s, want %s", tx.Status, TxConfirmed)
+	}
+
+	// never read back, reported once the window passed
+	frame = sendAndRead(message.New(2, []byte{0x04}))
+	if tx := status(); tx.Status != TxUnconfirmed {
+		t.Errorf("frame without echo %s, want %s", tx.Status, TxUnconfirmed)
+	}
+	if err := <-errs; !errors.Is(err, ErrPossibleCollision) {
+		t.Errorf("error %v, want %v", err, ErrPossibleCollision)
+	}
+
+	// read back too late, it must not pass as the reply
+	if err := b.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, ErrLateEcho) {
+		t.Errorf("error %v, want %v", err, ErrLateEcho)
+	}
+	reply := message.New(2, []byte{0x03, 0x15})
+	if err := b.WriteFrame(reply.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sub.Chan():
+		if !message.Equal(msg, reply) {
+			t.Errorf("subscriber got %X, want the reply %X", msg.Bytes(), reply.Bytes())
+		}
+	case <-ctx.Done():
+		t.Fatal("reply not delivered")
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error %v", err)
+	default:
+	}
+}
@@ -0,0 +1,227 @@
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AllIDs is the id mask that passes every frame
+const AllIDs uint16 = 0xffff
+
+var ErrFiltersUnsupported = errors.New("transport has no hardware filters")
+
+// DefaultFilterHold is how long the hardware filter keeps passing ids after the last subscriber for them is gone,
+// request subscribers come and go with every transaction and would otherwise rebuild the filters each time
+var DefaultFilterHold = 2 * time.Second
+
+// rxFilter counts the subscribers per message id and keeps the adapter filter in line with them
+type rxFilter struct {
+	mu      sync.Mutex
+	ft      FilterTransport // nil until FilterFrames is called
+	refs    [16]int
+	tx      uint16 // ids written on a transport that reads back its own frames
+	applied uint16 // what the adapter passes
+	narrow  *time.Timer
+}
+
+// FilterFrames has the adapter drop the frames no subscriber asks for, and rebuilds its filters as subscribers come
+// and go. Subscribers registered with Subscribe need the ids they were given, those with an IDMatcher the ids it
+// returns, every other subscriber needs every id.
+// On transports that read back their own frames the ids written pass as well. OnIncoming only sees the frames that pass.
+func (e *Engine) FilterFrames() error {
+	if e.isClosed() {
+		return ErrClosed
+	}
+	ft, ok := e.t.(FilterTransport)
+	if !ok {
+		return ErrFiltersUnsupported
+	}
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ft != nil {
+		return nil
+	}
+	f.ft = ft
+	f.applied = AllIDs
+	if want := f.wanted(); want != AllIDs {
+		return e.applyFilter(want)
+	}
+	return nil
+}
+
+// FilterMask returns the ids the adapter currently passes, AllIDs while filtering is off
+func (e *Engine) FilterMask() uint16 {
+	e.filter.mu.Lock()
+	defer e.filter.mu.Unlock()
+	if e.filter.ft == nil {
+		return AllIDs
+	}
+	return e.filter.applied
+}
+
+// subscriberMask returns the ids sub needs
+func subscriberMask(sub *Subscriber) uint16 {
+	ids := sub.GetIDFilter()
+	if sub.match != nil {
+		m, ok := sub.match.(IDMatcher)
+		if !ok {
+			return AllIDs
+		}
+		ids = m.IDs()
+	}
+	if len(ids) == 0 {
+		return AllIDs
+	}
+	var mask uint16
+	for _, id := range ids {
+		mask |= 1 << (id & 0x0f)
+	}
+	return mask
+}
+
+// wanted returns the ids at least one subscriber needs and the ids whose echo confirms a transmission,
+// f.mu must be held
+func (f *rxFilter) wanted() uint16 {
+	mask := f.tx
+	for id, n := range f.refs {
+		if n > 0 {
+			mask |= 1 << id
+		}
+	}
+	return mask
+}
+
+func (f *rxFilter) count(mask uint16, delta int) {
+	for id := range f.refs {
+		if mask&(1<<id) != 0 {
+			f.refs[id] += delta
+		}
+	}
+}
+
+// filterAdd counts sub before it is registered, the adapter passes its ids once filterAdd returns
+func (e *Engine) filterAdd(sub *Subscriber) {
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub.fmask = subscriberMask(sub)
+	sub.counted = true
+	f.count(sub.fmask, 1)
+	e.widenFilter()
+}
+
+// filterRemove stops counting sub, it is safe to call for a subscriber that was never counted
+func (e *Engine) filterRemove(sub *Subscriber) {
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !sub.counted {
+		return
+	}
+	sub.counted = false
+	f.count(sub.fmask, -1)
+	e.scheduleNarrow()
+}
+
+// filterUpdate recounts sub after its id filter changed
+func (e *Engine) filterUpdate(sub *Subscriber) {
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !sub.counted {
+		return
+	}
+	f.count(sub.fmask, -1)
+	sub.fmask = subscriberMask(sub)
+	f.count(sub.fmask, 1)
+	e.widenFilter()
+	e.scheduleNarrow()
+}
+
+// filterTx has the filter pass id before a frame with it is written, the echo that confirms it has to get through
+func (e *Engine) filterTx(id uint8) {
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bit := uint16(1) << (id & 0x0f)
+	if f.tx&bit != 0 {
+		return
+	}
+	f.tx |= bit
+	e.widenFilter()
+}
+
+// widenFilter adds the wanted ids the adapter does not pass yet, e.filter.mu must be held
+func (e *Engine) widenFilter() {
+	f := &e.filter
+	if f.ft == nil {
+		return
+	}
+	want := f.wanted()
+	if want&^f.applied == 0 {
+		return
+	}
+	if err := e.applyFilter(f.applied | want); err != nil {
+		e.OnError(err)
+	}
+}
+
+// scheduleNarrow drops the ids nobody wants any more after DefaultFilterHold, e.filter.mu must be held
+func (e *Engine) scheduleNarrow() {
+	f := &e.filter
+	if f.ft == nil || f.narrow != nil || f.applied&^f.wanted() == 0 {
+		return
+	}
+	f.narrow = time.AfterFunc(DefaultFilterHold, e.narrowFilter)
+}
+
+func (e *Engine) narrowFilter() {
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.narrow = nil
+	if want := f.wanted(); want != f.applied {
+		if err := e.applyFilter(want); err != nil {
+			e.OnError(err)
+		}
+	}
+}
+
+// restoreFilter installs the filter again after the transport was reopened with its default pass-all filter
+func (e *Engine) restoreFilter() {
+	f := &e.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ft == nil {
+		return
+	}
+	f.applied = AllIDs
+	if want := f.wanted(); want != AllIDs {
+		if err := e.applyFilter(want); err != nil {
+			e.OnError(err)
+		}
+	}
+}
+
+// applyFilter sets the adapter filter to mask, if that fails it tries to pass everything so no subscriber misses
+// frames. e.filter.mu must be held, it is taken before e.tmu.
+func (e *Engine) applyFilter(mask uint16) error {
+	f := &e.filter
+	e.tmu.RLock()
+	defer e.tmu.RUnlock()
+	if e.isClosed() {
+		return nil
+	}
+	err := f.ft.SetRxFilter(mask)
+	if err == nil {
+		f.applied = mask
+		return nil
+	}
+	if err2 := f.ft.SetRxFilter(AllIDs); err2 == nil {
+		f.applied = AllIDs
+	}
+	return fmt.Errorf("set filter %04X: %w", mask, err)
+}
@@ -0,0 +1,108 @@
+package kline
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// filterPipe is a pipe end with hardware filters, it records every mask set
+type filterPipe struct {
+	Transport
+	mu    sync.Mutex
+	masks []uint16
+}
+
+func (p *filterPipe) SetRxFilter(ids uint16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.masks = append(p.masks, ids)
+	return nil
+}
+
+func (p *filterPipe) setMasks() []uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]uint16(nil), p.masks...)
+}
+
+func TestFilterMaskForMatchers(t *testing.T) {
+	a, b := NewPipe()
+	ft := &filterPipe{Transport: a}
+	e, err := NewWithTransport(ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	// the other end answers every request to the transponder
+	go func() {
+		for {
+			frame, err := b.ReadFrame()
+			if err != nil {
+				return
+			}
+			if len(frame.Data) > 0 {
+				b.WriteFrame(message.New(2, []byte{0x03, 0x15}).Bytes())
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := e.Subscribe(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := e.FilterFrames(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, match := range []Matcher{MatchCommand(2, 0x03), MatchID(2)} {
+		if _, err := e.SendAndRecv(ctx, message.New(2, []byte{0x03, 0x1f}), match); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the subscriber for id 1 until the first request, both ids after, no pass-all in between
+	masks := ft.setMasks()
+	if len(masks) != 2 || masks[0] != 0x0002 || masks[1] != 0x0006 {
+		t.Errorf("masks set %04X, want [0002 0006]", masks)
+	}
+
+	// a subscriber with any other matcher needs every id
+	all, err := e.SubscribeFunc(ctx, MatchFunc(func(msg message.Message) bool { return true }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	if mask := e.FilterMask(); mask != AllIDs {
+		t.Errorf("filter mask %04X with a MatchFunc subscriber, want %04X", mask, AllIDs)
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		name  string
+		match Matcher
+		msg   message.Message
+		want  bool
+	}{
+		{"id", MatchID(1, 2), message.New(2, []byte{0x04}), true},
+		{"other id", MatchID(1, 2), message.New(3, []byte{0x04}), false},
+		{"command", MatchCommand(2, 0x04, 0x05), message.New(2, []byte{0x05, 0x00}), true},
+		{"other command", MatchCommand(2, 0x04), message.New(2, []byte{0x05}), false},
+		{"command on other id", MatchCommand(2, 0x04), message.New(3, []byte{0x04}), false},
+		{"no data", MatchCommand(2, 0x04), message.New(2, nil), false},
+		{"no commands", MatchCommand(2), message.New(2, []byte{0x04}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.Match(tt.msg); got != tt.want {
+				t.Errorf("Match(%X) = %v, want %v", tt.msg.Bytes(), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package kline
+
+import (
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// RxStatusTxMsg is the J2534 TX_MSG_TYPE bit, set on frames the adapter read back from its own transmission
+const RxStatusTxMsg uint32 = 0x01
+
+// Frame is a raw frame without checksum together with the status the adapter reported for it
+type Frame struct {
+	Data []byte
+	// RxStatus is the J2534 receive status, see RxStatusTxMsg
+	RxStatus uint32
+	// Timestamp is the adapter timestamp in microseconds, 0 if the transport has no clock of its own
+	Timestamp uint32
+	// Received is the host time the frame was read, the engine sets it if the transport leaves it zero
+	Received time.Time
+}
+
+// RxMsg is a received message that keeps the adapter metadata of its frame.
+// Subscribers and OnIncoming get message.Message values that can be asserted to *RxMsg.
+type RxMsg struct {
+	message.Message
+	RxStatus  uint32
+	Timestamp uint32
+	Received  time.Time
+}
+
+// TxStatus is what is known about a written frame making it onto the line
+type TxStatus int
+
+const (
+	// TxWritten means the transport took the frame but does not read transmissions back
+	TxWritten TxStatus = iota
+	// TxConfirmed means the frame was read back from the line
+	TxConfirmed
+	// TxUnconfirmed means the frame was not read back within the echo window, it may have collided
+	TxUnconfirmed
+)
+
+func (s TxStatus) String() string {
+	switch s {
+	case TxWritten:
+		return "written"
+	case TxConfirmed:
+		return "confirmed"
+	case TxUnconfirmed:
+		return "unconfirmed"
+	default:
+		return "unknown"
+	}
+}
+
+// TxMsg is a transmitted message with what the transport reported about it.
+// OnOutgoing gets message.Message values that can be asserted to *TxMsg, on transports that read back their own
+// frames it is called once the echo arrived or the echo window of the transport passed without it.
+type TxMsg struct {
+	message.Message
+	Status TxStatus
+	// Written is the host time the frame was handed to the transport
+	Written time.Time
+	// Confirmed is the host time the echo was read, RxStatus and Timestamp are the adapter values of the echo
+	Confirmed time.Time
+	RxStatus  uint32
+	Timestamp uint32
+}
@@ -0,0 +1,67 @@
+package kline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AdapterInfo identifies the adapter behind a transport for support reports
+type AdapterInfo struct {
+	Transport string
+	Library   string
+
+	// Firmware, DLL and API are the versions reported by PassThruReadVersion
+	Firmware string
+	DLL      string
+	API      string
+
+	// Config holds the SCONFIG values read back from the channel
+	Config []ConfigValue
+
+	// LastError is the PassThruGetLastError text
+	LastError string
+}
+
+// ConfigValue is one SCONFIG parameter
+type ConfigValue struct {
+	Name      string
+	Parameter uint32
+	Value     uint32
+}
+
+func (c ConfigValue) String() string {
+	return fmt.Sprintf("%s=%d", c.Name, c.Value)
+}
+
+func (i AdapterInfo) String() string {
+	var sb strings.Builder
+	sb.WriteString(i.Transport)
+	if i.Library != "" {
+		fmt.Fprintf(&sb, " %s", i.Library)
+	}
+	if i.Firmware != "" || i.DLL != "" || i.API != "" {
+		fmt.Fprintf(&sb, " firmware %s dll %s api %s", i.Firmware, i.DLL, i.API)
+	}
+	for _, c := range i.Config {
+		fmt.Fprintf(&sb, " %s", c)
+	}
+	if i.LastError != "" {
+		fmt.Fprintf(&sb, " last error %q", i.LastError)
+	}
+	return sb.String()
+}
+
+// AdapterInfo returns what the transport reports about its adapter, transports that can not identify it only
+// fill in Transport. The info gathered so far is returned along with any error.
+func (e *Engine) AdapterInfo() (AdapterInfo, error) {
+	if e.isClosed() {
+		return AdapterInfo{}, ErrClosed
+	}
+	e.tmu.RLock()
+	defer e.tmu.RUnlock()
+	it, ok := e.t.(InfoTransport)
+	if !ok {
+		return AdapterInfo{Transport: e.t.Capabilities().Name}, nil
+	}
+	return it.AdapterInfo()
+}
@@ -0,0 +1,502 @@
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// ProtocolISO9141 is the J2534 protocol id of the ISO9141 K-line
+const ProtocolISO9141 = 0x03
+
+// MongooseLibrary is the DLL of the Drew Technologies Mongoose Pro GM II the tool was written against
+const MongooseLibrary = `C:\Program Files (x86)\Drew Technologies, Inc\J2534\MongoosePro GM II\monpa432.dll`
+
+// J2534Config holds the adapter and read options of the J2534 transport
+type J2534Config struct {
+	// Library is the path of the J2534 DLL of the adapter
+	Library string
+	// Protocol, BaudRate and Flags are passed to PassThruConnect, BaudRate is also set as DATA_RATE
+	Protocol uint32
+	BaudRate uint32
+	Flags    uint32
+	// Loopback has the adapter read back transmitted frames, they confirm each transmission with the adapter timestamp
+	Loopback bool
+	// EchoWindow is how long a loopback frame may take to be read back, zero for DefaultEchoWindow
+	EchoWindow time.Duration
+
+	// ReadTimeout is how long PassThruReadMsgs blocks waiting for messages
+	ReadTimeout time.Duration
+	// BatchSize is the maximum number of messages fetched per PassThruReadMsgs call
+	BatchSize int
+}
+
+var DefaultJ2534Config = J2534Config{
+	Library:     MongooseLibrary,
+	Protocol:    ProtocolISO9141,
+	BaudRate:    9600,
+	Flags:       0x00001000,
+	ReadTimeout: 50 * time.Millisecond,
+	BatchSize:   16,
+}
+
+// j2534ConfigParams are the SCONFIG parameters read back for AdapterInfo, the ones Open sets and the K-line timing
+var j2534ConfigParams = []ConfigValue{
+	{Name: "DATA_RATE", Parameter: paramDataRate},
+	{Name: "LOOPBACK", Parameter: paramLoopback},
+	{Name: "PARITY", Parameter: paramParity},
+	{Name: "DATA_BITS", Parameter: paramDataBits},
+	{Name: "P1_MAX", Parameter: paramP1Max},
+	{Name: "P3_MIN", Parameter: paramP3Min},
+	{Name: "P4_MIN", Parameter: paramP4Min},
+}
+
+type j2534 struct {
+	h   passthruAPI
+	cfg J2534Config
+
+	// load opens the DLL, it is replaced by a fake passthru to run the transport without an adapter
+	load func(dllName string) (passthruAPI, error)
+
+	channelID, deviceID, flags, protocol uint32
+
+	// the filters running on the channel, pass and block by message id, passAll is the filter id of the pass-all
+	// filter while allowAll is set
+	pass, block map[uint8]uint32
+	passAll     uint32
+	allowAll    bool
+
+	// rmu is held by ReadFrame and hmu by every other call using h, Open and Close take both in that order.
+	// The engine closes the transport while its reader or writer may still be in a call.
+	rmu     sync.Mutex
+	hmu     sync.Mutex
+	batch   []passThruMsg
+	pending []Frame
+}
+
+// NewJ2534Transport returns a transport using the J2534 adapter in cfg, an empty Library, Protocol or BaudRate is taken from DefaultJ2534Config
+func NewJ2534Transport(cfg J2534Config) Transport {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.Library == "" {
+		cfg.Library = DefaultJ2534Config.Library
+	}
+	if cfg.Protocol == 0 {
+		cfg.Protocol = DefaultJ2534Config.Protocol
+	}
+	if cfg.BaudRate == 0 {
+		cfg.BaudRate = DefaultJ2534Config.BaudRate
+	}
+	return &j2534{
+		cfg:       cfg,
+		load:      loadPassthru,
+		channelID: 1,
+		deviceID:  1,
+		flags:     cfg.Flags,
+		protocol:  cfg.Protocol,
+		batch:     make([]passThruMsg, cfg.BatchSize),
+	}
+}
+
+// Open loads the DLL, connects the channel and applies the SCONFIG values and filters, it is called again on reconnect
+func (j *j2534) Open() error {
+	j.rmu.Lock()
+	defer j.rmu.Unlock()
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	return j.open()
+}
+
+func (j *j2534) open() error {
+	pt, err := j.load(j.cfg.Library)
+	if err != nil {
+		return err
+	}
+
+	if err := pt.PassThruOpen("", &j.deviceID); err != nil {
+		defer pt.Close()
+		if str, err2 := pt.PassThruGetLastError(); err2 == nil {
+			return fmt.Errorf("PassThruOpen: %w: %s", err, str)
+		}
+		return fmt.Errorf("PassThruOpen: %w", err)
+	}
+	j.h = pt
+
+	if err := pt.PassThruConnect(j.deviceID, j.protocol, j.flags, j.cfg.BaudRate, &j.channelID); err != nil {
+		j.close()
+		return fmt.Errorf("PassThruConnect: %w", err)
+	}
+
+	loopback := uint32(0)
+	if j.cfg.Loopback {
+		loopback = 1
+	}
+	opts := &sconfigList{
+		NumOfParams: 4,
+		Params: []sconfig{
+			{
+				Parameter: paramLoopback,
+				Value:     loopback,
+			},
+			{
+				Parameter: paramParity,
+				Value:     1,
+			},
+			{
+				Parameter: paramDataBits,
+				Value:     0,
+			},
+			{
+				Parameter: paramDataRate,
+				Value:     j.cfg.BaudRate,
+			},
+		},
+	}
+	if err := pt.PassThruIoctl(j.channelID, ioctlSetConfig, opts, nil); err != nil {
+		j.close()
+		return fmt.Errorf("PassThruIoctl set options: %w", err)
+	}
+
+	j.pending = nil
+	j.pass = make(map[uint8]uint32)
+	j.block = make(map[uint8]uint32)
+	j.allowAll = false
+
+	if err := j.startAllowAll(); err != nil {
+		j.close()
+		return err
+	}
+	return nil
+}
+
+func (j *j2534) startAllowAll() error {
+	if j.allowAll {
+		return nil
+	}
+	filterID, err := j.idFilter(passFilter, 0x00, 0x00)
+	if err != nil {
+		return err
+	}
+	j.passAll, j.allowAll = filterID, true
+	return nil
+}
+
+func (j *j2534) stopAllowAll() error {
+	if !j.allowAll {
+		return nil
+	}
+	if err := j.stopFilter(j.passAll); err != nil {
+		return err
+	}
+	j.allowAll = false
+	return nil
+}
+
+// idFilter starts a filter on the first frame byte, its high nibble is the message id
+func (j *j2534) idFilter(filterType uint32, mask, pattern byte) (uint32, error) {
+	filterID := uint32(0)
+	maskMsg := &passThruMsg{
+		ProtocolID: j.protocol,
+		DataSize:   1,
+		Data:       [4128]byte{mask},
+	}
+	patternMsg := &passThruMsg{
+		ProtocolID: j.protocol,
+		DataSize:   1,
+		Data:       [4128]byte{pattern},
+	}
+	if err := j.h.PassThruStartMsgFilter(j.channelID, filterType, maskMsg, patternMsg, nil, &filterID); err != nil {
+		return 0, fmt.Errorf("PassThruStartMsgFilter: %w", err)
+	}
+	return filterID, nil
+}
+
+func (j *j2534) stopFilter(filterID uint32) error {
+	if err := j.h.PassThruStopMsgFilter(j.channelID, filterID); err != nil {
+		return fmt.Errorf("PassThruStopMsgFilter: %w", err)
+	}
+	return nil
+}
+
+// SetRxFilter uses a PASS filter per wanted id, or a pass-all filter with a BLOCK filter per unwanted id when that
+// takes fewer, so no more than 8 of the 10 filters J2534 guarantees per channel are used. The filters are changed one
+// at a time, whatever widens what passes first, so an id wanted before and after is never blocked in between and no
+// more than 9 filters run at once.
+func (j *j2534) SetRxFilter(ids uint16) error {
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	if j.h == nil {
+		return linkDown(errors.New("adapter not open"))
+	}
+	if bits.OnesCount16(ids) <= 8 {
+		for id, filterID := range j.block {
+			if err := j.stopFilter(filterID); err != nil {
+				return err
+			}
+			delete(j.block, id)
+		}
+		for id, filterID := range j.pass {
+			if ids&(1<<id) == 0 {
+				if err := j.stopFilter(filterID); err != nil {
+					return err
+				}
+				delete(j.pass, id)
+			}
+		}
+		for id := uint8(0); id < 16; id++ {
+			if _, running := j.pass[id]; running || ids&(1<<id) == 0 {
+				continue
+			}
+			filterID, err := j.idFilter(passFilter, 0xf0, id<<4)
+			if err != nil {
+				return err
+			}
+			j.pass[id] = filterID
+		}
+		return j.stopAllowAll()
+	}
+	if err := j.startAllowAll(); err != nil {
+		return err
+	}
+	for id, filterID := range j.pass {
+		if err := j.stopFilter(filterID); err != nil {
+			return err
+		}
+		delete(j.pass, id)
+	}
+	for id, filterID := range j.block {
+		if ids&(1<<id) != 0 {
+			if err := j.stopFilter(filterID); err != nil {
+				return err
+			}
+			delete(j.block, id)
+		}
+	}
+	for id := uint8(0); id < 16; id++ {
+		if _, running := j.block[id]; running || ids&(1<<id) != 0 {
+			continue
+		}
+		filterID, err := j.idFilter(blockFilter, 0xf0, id<<4)
+		if err != nil {
+			return err
+		}
+		j.block[id] = filterID
+	}
+	return nil
+}
+
+// Close tears down filters, periodic messages, the channel and the device, and reports every step that failed
+func (j *j2534) Close() error {
+	j.rmu.Lock()
+	defer j.rmu.Unlock()
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	return j.close()
+}
+
+func (j *j2534) close() error {
+	if j.h == nil {
+		return nil
+	}
+	defer func() { j.h = nil }()
+	var errs []error
+	if err := j.h.PassThruIoctl(j.channelID, ioctlClearPeriodicMsgs, nil, nil); err != nil {
+		errs = append(errs, fmt.Errorf("clear periodic messages: %w", err))
+	}
+	if err := j.h.PassThruIoctl(j.channelID, ioctlClearMsgFilters, nil, nil); err != nil {
+		errs = append(errs, fmt.Errorf("clear filters: %w", err))
+	}
+	if err := j.h.PassThruDisconnect(j.channelID); err != nil {
+		errs = append(errs, fmt.Errorf("PassThruDisconnect: %w", err))
+	}
+	if err := j.h.PassThruClose(j.deviceID); err != nil {
+		errs = append(errs, fmt.Errorf("PassThruClose: %w", err))
+	}
+	if err := j.h.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("release DLL: %w", err))
+	}
+	return closeErrors(errs...)
+}
+
+func (j *j2534) ReadFrame() (Frame, error) {
+	j.rmu.Lock()
+	defer j.rmu.Unlock()
+	if j.h == nil {
+		return Frame{}, ErrTransportClosed
+	}
+	if len(j.pending) == 0 {
+		if err := j.readBatch(); err != nil {
+			return Frame{}, err
+		}
+	}
+	if len(j.pending) == 0 {
+		return Frame{}, nil
+	}
+	f := j.pending[0]
+	j.pending = j.pending[1:]
+	return f, nil
+}
+
+// readBatch blocks for up to ReadTimeout and queues every message the adapter returned
+func (j *j2534) readBatch() error {
+	// gocan passes pNumMsgs by value so the number of messages read is lost,
+	// clear the protocol id of every slot and count the ones the adapter filled in instead
+	for i := range j.batch {
+		j.batch[i].ProtocolID = 0
+		j.batch[i].DataSize = 0
+	}
+	timeout := uint32(j.cfg.ReadTimeout / time.Millisecond)
+	if err := j.h.PassThruReadMsgs(j.channelID, &j.batch[0], uint32(len(j.batch)), timeout); err != nil {
+		switch {
+		case errors.Is(err, errPassThruBufferEmpty), errors.Is(err, errPassThruTimeout):
+			// ERR_TIMEOUT still delivers the messages read so far
+		case errors.Is(err, errPassThruDeviceNotConnected):
+			return linkDown(fmt.Errorf("device not connected: %w", err))
+		default:
+			return fmt.Errorf("read error: %w", err)
+		}
+	}
+	received := time.Now()
+	for i := range j.batch {
+		msg := &j.batch[i]
+		if msg.ProtocolID == 0 {
+			break
+		}
+		if msg.DataSize == 0 {
+			//e.OnError(fmt.Errorf("empty message received: %08X", msg.RxStatus))
+			continue
+		}
+		data := make([]byte, msg.DataSize)
+		copy(data, msg.Data[:msg.DataSize])
+		j.pending = append(j.pending, Frame{
+			Data:      data,
+			RxStatus:  msg.RxStatus,
+			Timestamp: msg.Timestamp,
+			Received:  received,
+		})
+	}
+	return nil
+}
+
+func (j *j2534) WriteFrame(frame []byte) error {
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	if j.h == nil {
+		return ErrTransportClosed
+	}
+	msg := &passThruMsg{
+		ProtocolID: j.protocol,
+		DataSize:   uint32(len(frame)),
+		TxFlags:    0,
+	}
+	copy(msg.Data[:], frame)
+	if err := j.h.PassThruWriteMsgs(j.channelID, msg, 1, 0); err != nil {
+		if errors.Is(err, errPassThruDeviceNotConnected) {
+			return linkDown(err)
+		}
+		if errStr, err2 := j.h.PassThruGetLastError(); err2 == nil {
+			return fmt.Errorf("%w: %s", err, errStr)
+		}
+		return err
+	}
+	return nil
+}
+
+// StartPeriodic has the adapter send frame every period, J2534 allows 5 to 65535 ms
+func (j *j2534) StartPeriodic(frame []byte, period time.Duration) (uint32, error) {
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	if j.h == nil {
+		return 0, linkDown(errors.New("adapter not open"))
+	}
+	interval := period / time.Millisecond
+	if interval < 5 || interval > 65535 {
+		return 0, fmt.Errorf("periodic interval %s out of range", period)
+	}
+	msg := &passThruMsg{
+		ProtocolID: j.protocol,
+		DataSize:   uint32(len(frame)),
+	}
+	copy(msg.Data[:], frame)
+	var id uint32
+	if err := j.h.PassThruStartPeriodicMsg(j.channelID, msg, &id, uint32(interval)); err != nil {
+		if errStr, err2 := j.h.PassThruGetLastError(); err2 == nil {
+			return 0, fmt.Errorf("PassThruStartPeriodicMsg: %w: %s", err, errStr)
+		}
+		return 0, fmt.Errorf("PassThruStartPeriodicMsg: %w", err)
+	}
+	return id, nil
+}
+
+func (j *j2534) StopPeriodic(id uint32) error {
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	if j.h == nil {
+		return nil
+	}
+	if err := j.h.PassThruStopPeriodicMsg(j.channelID, id); err != nil {
+		return fmt.Errorf("PassThruStopPeriodicMsg: %w", err)
+	}
+	return nil
+}
+
+// ReadVoltage returns the battery voltage the adapter measures on pin 16
+func (j *j2534) ReadVoltage() (float64, error) {
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	if j.h == nil {
+		return 0, linkDown(errors.New("adapter not open"))
+	}
+	var mv uint32
+	if err := j.h.PassThruIoctl(j.deviceID, ioctlReadVBatt, nil, &mv); err != nil {
+		switch {
+		case errors.Is(err, errPassThruDeviceNotConnected):
+			return 0, linkDown(err)
+		case errors.Is(err, errPassThruNotSupported), errors.Is(err, errPassThruInvalidIoctlID):
+			return 0, fmt.Errorf("%w: %v", ErrVoltageUnsupported, err)
+		}
+		return 0, fmt.Errorf("PassThruIoctl READ_VBATT: %w", err)
+	}
+	return float64(mv) / 1000, nil
+}
+
+// AdapterInfo reads the last error text first, before the other calls can replace it
+func (j *j2534) AdapterInfo() (AdapterInfo, error) {
+	info := AdapterInfo{Transport: "J2534", Library: j.cfg.Library}
+	j.hmu.Lock()
+	defer j.hmu.Unlock()
+	if j.h == nil {
+		return info, linkDown(errors.New("adapter not open"))
+	}
+	if str, err := j.h.PassThruGetLastError(); err == nil {
+		info.LastError = str
+	}
+	var errs []error
+	fw, dll, api, err := j.h.PassThruReadVersion(j.deviceID)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("PassThruReadVersion: %w", err))
+	}
+	info.Firmware, info.DLL, info.API = fw, dll, api
+
+	params := make([]sconfig, len(j2534ConfigParams))
+	for i, p := range j2534ConfigParams {
+		params[i].Parameter = p.Parameter
+	}
+	list := &sconfigList{NumOfParams: uint32(len(params)), Params: params}
+	if err := j.h.PassThruIoctl(j.channelID, ioctlGetConfig, list, nil); err != nil {
+		errs = append(errs, fmt.Errorf("PassThruIoctl GET_CONFIG: %w", err))
+	} else {
+		for i, p := range j2534ConfigParams {
+			p.Value = params[i].Value
+			info.Config = append(info.Config, p)
+		}
+	}
+	return info, closeErrors(errs...)
+}
+
+func (j *j2534) Capabilities() Capabilities {
+	return Capabilities{Name: "J2534", Echo: j.cfg.Loopback, EchoWindow: j.cfg.EchoWindow}
+}
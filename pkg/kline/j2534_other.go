@@ -0,0 +1,11 @@
+//go:build !windows
+
+package kline
+
+// defaultJ2534Adapters is empty, J2534 needs the windows DLL
+var defaultJ2534Adapters []Adapter
+
+// installedJ2534 returns nothing, the PassThruSupport registry key only exists on windows
+func installedJ2534() []Adapter {
+	return nil
+}
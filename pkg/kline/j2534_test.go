@@ -0,0 +1,372 @@
+package kline
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+type fakePeriodic struct {
+	data     []byte
+	interval uint32
+}
+
+type fakeFilter struct {
+	filterType    uint32
+	mask, pattern byte
+}
+
+// fakePassthru stands in for the J2534 DLL, it keeps the periodic messages the adapter would send and its filters
+type fakePassthru struct {
+	mu        sync.Mutex
+	periodics map[uint32]fakePeriodic
+	nextID    uint32
+	opens     int
+	writes    int
+	filters   map[uint32]fakeFilter
+	// passed is what the filters pass after every change, most the highest number of filters that ran at once
+	passed []uint16
+	most   int
+	// startErr fails PassThruStartPeriodicMsg
+	startErr error
+	// unplugged fails reads with ERR_DEVICE_NOT_CONNECTED until the next open
+	unplugged bool
+}
+
+func newFakePassthru() *fakePassthru {
+	return &fakePassthru{periodics: make(map[uint32]fakePeriodic), filters: make(map[uint32]fakeFilter)}
+}
+
+func (f *fakePassthru) PassThruOpen(deviceName string, pDeviceID *uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opens++
+	f.unplugged = false
+	*pDeviceID = 1
+	return nil
+}
+
+func (f *fakePassthru) PassThruClose(deviceID uint32) error { return nil }
+
+func (f *fakePassthru) PassThruConnect(deviceID uint32, protocolID uint32, flags uint32, baudRate uint32, pChannelID *uint32) error {
+	*pChannelID = 1
+	return nil
+}
+
+func (f *fakePassthru) PassThruDisconnect(channelID uint32) error { return nil }
+
+func (f *fakePassthru) PassThruReadMsgs(channelID uint32, pMsg *passThruMsg, pNumMsgs uint32, timeout uint32) error {
+	f.mu.Lock()
+	unplugged := f.unplugged
+	f.mu.Unlock()
+	if unplugged {
+		return errPassThruDeviceNotConnected
+	}
+	time.Sleep(time.Duration(timeout) * time.Millisecond)
+	return errPassThruTimeout
+}
+
+func (f *fakePassthru) PassThruWriteMsgs(channelID uint32, pMsg *passThruMsg, pNumMsgs uint32, timeout uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes++
+	return nil
+}
+
+func (f *fakePassthru) PassThruStartMsgFilter(channelID uint32, filterType uint32, pMaskMsg, pPatternMsg, pFlowControlMsg *passThruMsg, pMsgID *uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.filters[f.nextID] = fakeFilter{filterType: filterType, mask: pMaskMsg.Data[0], pattern: pPatternMsg.Data[0]}
+	*pMsgID = f.nextID
+	f.filtersChanged()
+	return nil
+}
+
+func (f *fakePassthru) PassThruStopMsgFilter(channelID uint32, filterID uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.filters[filterID]; !ok {
+		return errPassThruInvalidFilterID
+	}
+	delete(f.filters, filterID)
+	f.filtersChanged()
+	return nil
+}
+
+// filtersChanged records what passes now, f.mu must be held
+func (f *fakePassthru) filtersChanged() {
+	if len(f.filters) > f.most {
+		f.most = len(f.filters)
+	}
+	var mask uint16
+	for id := 0; id < 16; id++ {
+		var pass, block bool
+		for _, filter := range f.filters {
+			if byte(id<<4)&filter.mask != filter.pattern {
+				continue
+			}
+			switch filter.filterType {
+			case passFilter:
+				pass = true
+			case blockFilter:
+				block = true
+			}
+		}
+		if pass && !block {
+			mask |= 1 << id
+		}
+	}
+	f.passed = append(f.passed, mask)
+}
+
+// filterHistory returns what passed after every filter change since the last call and the most filters that ran at once
+func (f *fakePassthru) filterHistory() ([]uint16, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	passed, most := f.passed, f.most
+	f.passed, f.most = nil, len(f.filters)
+	return passed, most
+}
+
+func (f *fakePassthru) PassThruIoctl(handleID uint32, ioctlID uint32, pInput *sconfigList, pOutput *uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch ioctlID {
+	case ioctlClearPeriodicMsgs:
+		f.periodics = make(map[uint32]fakePeriodic)
+	case ioctlClearMsgFilters:
+		f.filters = make(map[uint32]fakeFilter)
+		f.filtersChanged()
+	}
+	return nil
+}
+
+func (f *fakePassthru) PassThruGetLastError() (string, error) {
+	return "fake adapter", nil
+}
+
+func (f *fakePassthru) PassThruReadVersion(deviceID uint32) (string, string, string, error) {
+	return "1.0", "1.0", "04.04", nil
+}
+
+func (f *fakePassthru) PassThruStartPeriodicMsg(channelID uint32, pMsg *passThruMsg, pMsgID *uint32, interval uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.nextID++
+	f.periodics[f.nextID] = fakePeriodic{
+		data:     append([]byte(nil), pMsg.Data[:pMsg.DataSize]...),
+		interval: interval,
+	}
+	*pMsgID = f.nextID
+	return nil
+}
+
+func (f *fakePassthru) PassThruStopPeriodicMsg(channelID uint32, msgID uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.periodics[msgID]; !ok {
+		return errPassThruInvalidMsgID
+	}
+	delete(f.periodics, msgID)
+	return nil
+}
+
+func (f *fakePassthru) Close() error { return nil }
+
+func (f *fakePassthru) unplug() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unplugged = true
+}
+
+// scheduled returns the periodic messages the adapter sends
+func (f *fakePassthru) scheduled() []fakePeriodic {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]fakePeriodic, 0, len(f.periodics))
+	for _, p := range f.periodics {
+		out = append(out, p)
+	}
+	return out
+}
+
+func (f *fakePassthru) openCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.opens
+}
+
+func (f *fakePassthru) writeCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+// newFakeJ2534 returns an engine on a J2534 transport backed by f
+func newFakeJ2534(t *testing.T, f *fakePassthru, opts Options) *Engine {
+	t.Helper()
+	tr := NewJ2534Transport(DefaultJ2534Config).(*j2534)
+	tr.load = func(string) (passthruAPI, error) { return f, nil }
+	e, err := NewWithOptions(tr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// wantScheduled fails t unless the adapter sends msg every period, or nothing if msg is nil
+func wantScheduled(t *testing.T, f *fakePassthru, period time.Duration, msg message.Message) {
+	t.Helper()
+	got := f.scheduled()
+	if msg == nil {
+		if len(got) != 0 {
+			t.Fatalf("adapter sends %d periodic messages, want none", len(got))
+		}
+		return
+	}
+	if len(got) != 1 {
+		t.Fatalf("adapter sends %d periodic messages, want 1", len(got))
+	}
+	if !bytes.Equal(got[0].data, msg.Bytes()) {
+		t.Errorf("adapter sends %X, want %X", got[0].data, msg.Bytes())
+	}
+	if got[0].interval != uint32(period/time.Millisecond) {
+		t.Errorf("adapter interval %dms, want %s", got[0].interval, period)
+	}
+}
+
+func TestJ2534PeriodicStartStop(t *testing.T) {
+	f := newFakePassthru()
+	e := newFakeJ2534(t, f, Options{})
+	msg := message.New(10, []byte{0x00, 0x00, 0x00, 0x00, 0x00})
+
+	p := e.AddPeriodic(msg, PeriodicConfig{Period: 200 * time.Millisecond})
+	wantScheduled(t, f, 200*time.Millisecond, msg)
+	p.Stop()
+	wantScheduled(t, f, 0, nil)
+	// stopping twice does not reach the adapter again
+	p.Stop()
+}
+
+func TestJ2534PeriodicPauseResumePayload(t *testing.T) {
+	f := newFakePassthru()
+	e := newFakeJ2534(t, f, Options{OnError: func(err error) { t.Error(err) }})
+	first := message.New(10, []byte{0x01})
+	second := message.New(10, []byte{0x02})
+	third := message.New(10, []byte{0x03})
+
+	p := e.AddPeriodic(first, PeriodicConfig{Period: 100 * time.Millisecond})
+	p.Pause()
+	wantScheduled(t, f, 0, nil)
+	// a payload set while paused is what resuming schedules
+	p.SetPayload(second)
+	wantScheduled(t, f, 0, nil)
+	p.Resume()
+	wantScheduled(t, f, 100*time.Millisecond, second)
+	p.Resume()
+	wantScheduled(t, f, 100*time.Millisecond, second)
+	p.SetPayload(third)
+	wantScheduled(t, f, 100*time.Millisecond, third)
+	p.Stop()
+	wantScheduled(t, f, 0, nil)
+}
+
+func TestJ2534PeriodicRestartAfterReconnect(t *testing.T) {
+	f := newFakePassthru()
+	states := make(chan LinkState, 8)
+	e := newFakeJ2534(t, f, Options{
+		OnError:     func(err error) {},
+		OnLinkState: func(s LinkState) { states <- s },
+	})
+	running := message.New(10, []byte{0x01})
+	paused := message.New(11, []byte{0x02})
+	e.AddPeriodic(running, PeriodicConfig{Period: 100 * time.Millisecond})
+	e.AddPeriodic(paused, PeriodicConfig{Period: 100 * time.Millisecond}).Pause()
+	wantScheduled(t, f, 100*time.Millisecond, running)
+
+	f.unplug()
+	deadline := time.After(5 * time.Second)
+	for up := false; !up; {
+		select {
+		case s := <-states:
+			up = s == LinkUp
+		case <-deadline:
+			t.Fatal("link did not come back up")
+		}
+	}
+	if n := f.openCount(); n != 2 {
+		t.Errorf("adapter opened %d times, want 2", n)
+	}
+	// closing the adapter cleared its periodic messages, the running one is scheduled again
+	wantScheduled(t, f, 100*time.Millisecond, running)
+}
+
+func TestJ2534PeriodicTimerFallback(t *testing.T) {
+	f := newFakePassthru()
+	f.startErr = errPassThruNotSupported
+	errs := make(chan error, 8)
+	e := newFakeJ2534(t, f, Options{OnError: func(err error) { errs <- err }})
+
+	e.AddPeriodic(message.New(10, []byte{0x01}), PeriodicConfig{Period: 20 * time.Millisecond})
+	select {
+	case err := <-errs:
+		if !errors.Is(err, errPassThruNotSupported) || !strings.Contains(err.Error(), "using a timer") {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("adapter scheduling failure not reported")
+	}
+	wantScheduled(t, f, 0, nil)
+
+	// the engine sends the frame itself
+	deadline := time.Now().Add(time.Second)
+	for f.writeCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames written by the timer", f.writeCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJ2534FilterChange(t *testing.T) {
+	f := newFakePassthru()
+	tr := NewJ2534Transport(DefaultJ2534Config).(*j2534)
+	tr.load = func(string) (passthruAPI, error) { return f, nil }
+	if err := tr.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	f.filterHistory()
+
+	// from pass filters to block filters and back, id 2 stays wanted throughout
+	prev := AllIDs
+	for _, ids := range []uint16{0x0004, 0x000c, 0x0104, 0xfff4, 0xfef4, 0x0014, AllIDs, 0x0004} {
+		if err := tr.SetRxFilter(ids); err != nil {
+			t.Fatalf("%04X: %v", ids, err)
+		}
+		passed, most := f.filterHistory()
+		kept := prev & ids
+		for _, mask := range passed {
+			if mask&kept != kept {
+				t.Errorf("%04X to %04X: filters passed %04X in between", prev, ids, mask)
+			}
+		}
+		if len(passed) > 0 && passed[len(passed)-1] != ids {
+			t.Errorf("%04X to %04X: filters pass %04X", prev, ids, passed[len(passed)-1])
+		}
+		if most > 9 {
+			t.Errorf("%04X to %04X: %d filters at once", prev, ids, most)
+		}
+		prev = ids
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package kline
+
+import "github.com/roffe/gocan/adapter/passthru"
+
+var defaultJ2534Adapters = []Adapter{
+	{Name: "mongoose", Type: AdapterJ2534, Library: MongooseLibrary},
+}
+
+// installedJ2534 returns the J2534 adapters registered under the PassThruSupport.04.04 registry key
+func installedJ2534() []Adapter {
+	var adapters []Adapter
+	for _, dll := range passthru.FindDLLs() {
+		adapters = append(adapters, Adapter{
+			Name:      dll.Name,
+			Type:      AdapterJ2534,
+			Library:   dll.FunctionLibrary,
+			Installed: true,
+		})
+	}
+	return adapters
+}
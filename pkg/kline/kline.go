@@ -5,166 +5,157 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 
-	"github.com/roffe/gocan/adapter/passthru"
 	"github.com/roffe/ismtool/pkg/message"
 )
 
+// J2534 is the port name that selects the J2534 adapter instead of a serial port
+const J2534 = "j2534"
+
 type Engine struct {
-	h *passthru.PassThru
+	t   Transport
+	tmu sync.RWMutex // held for writing while the transport is reopened
 
-	channelID, deviceID, flags, protocol uint32
+	linkState atomic.Int32
 
 	incoming chan message.Message
-	outgoing chan message.Message
+	outgoing [numPriorities]chan message.Message // one queue per Priority
 
-	register   chan *Subscriber
+	register   chan *Subscriber // unbuffered, a subscriber is in listeners once the send completes
 	unregister chan *Subscriber
 
 	listeners map[*Subscriber]bool
 
-	//loopback *ringbuffer.RingBuffer
+	echo *echoFilter // nil unless the transport reads back its own frames
+
+	stats engineStats
+
+	pmu       sync.Mutex
+	periodics map[*Periodic]bool // frames scheduled on the adapter, started again after reconnect
+
+	vmu      sync.Mutex
+	voltage  []VoltageSample // latest last, at most DefaultVoltageHistory
+	vpolling bool
 
-	OnError    func(err error)
+	filter rxFilter
+
+	OnError func(err error)
+	// OnIncoming is called with a *RxMsg for every frame received that is not an echo
 	OnIncoming func(msg message.Message)
+	// OnOutgoing is called with a *TxMsg for every frame written, see TxMsg for when
 	OnOutgoing func(msg message.Message)
-
-	quit chan struct{}
+	// OnEvict is called when a subscriber is removed because it did not keep up, its channel is closed by then
+	OnEvict func(sub *Subscriber, err error)
+	// OnLinkState is called when the link goes down and comes back up, subscribers stay registered across reconnects
+	OnLinkState func(state LinkState)
+	// OnVoltage is called with every supply voltage sample, see PollVoltage
+	OnVoltage func(sample VoltageSample)
+
+	// ReconnectMin and ReconnectMax bound the backoff between reopen attempts
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+
+	lifeMu sync.Mutex // guards closed and wg.Add
+	closed bool
+	wg     sync.WaitGroup // every goroutine Close waits for
+	quit   chan struct{}  // closed when Close is called
+	done   chan struct{}  // closed when Close has finished
 }
 
+// New opens the K-line interface, portName is either J2534 or the name of a serial port such as COM6 or /dev/ttyUSB0
 func New(portName string) (*Engine, error) {
+	return NewWithTransport(NewTransport(portName))
+}
+
+// Options are the engine settings that have to be in place before its goroutines start
+type Options struct {
+	// OnError replaces the default of logging errors, see Engine.OnError
+	OnError func(err error)
+	// OnLinkState is called from the reader as soon as it runs, see Engine.OnLinkState
+	OnLinkState func(state LinkState)
+}
+
+// NewWithTransport opens t and starts the engine on top of it
+func NewWithTransport(t Transport) (*Engine, error) {
+	return NewWithOptions(t, Options{})
+}
+
+// NewWithOptions opens t and starts the engine on top of it with the callbacks of opts already set
+func NewWithOptions(t Transport, opts Options) (*Engine, error) {
 	e := &Engine{
+		t: t,
+
 		incoming: make(chan message.Message, 10),
-		outgoing: make(chan message.Message, 10),
 
-		register:   make(chan *Subscriber, 10),
+		register:   make(chan *Subscriber),
 		unregister: make(chan *Subscriber, 10),
 
 		listeners: map[*Subscriber]bool{},
+		periodics: map[*Periodic]bool{},
 
 		quit: make(chan struct{}),
+		done: make(chan struct{}),
 
 		OnError: func(err error) {
 			log.Println(err)
 		},
 
-		channelID: 1,
-		deviceID:  1,
-		protocol:  passthru.ISO9141,
-	}
+		OnLinkState: opts.OnLinkState,
 
-	pt, err := passthru.New(`C:\Program Files (x86)\Drew Technologies, Inc\J2534\MongoosePro GM II\monpa432.dll`)
-	if err != nil {
-		return nil, err
+		ReconnectMin: DefaultReconnectMin,
+		ReconnectMax: DefaultReconnectMax,
 	}
-
-	if err := pt.PassThruOpen("", &e.deviceID); err != nil {
-		str, err2 := pt.PassThruGetLastError()
-		if err2 != nil {
-			e.OnError(fmt.Errorf("PassThruOpenGetLastError: %w", err))
-		} else {
-
-			log.Println("PassThruOpen: " + str)
-		}
-		return nil, fmt.Errorf("PassThruOpen: %w", err)
+	if opts.OnError != nil {
+		e.OnError = opts.OnError
 	}
 
-	if err := pt.PassThruConnect(e.deviceID, e.protocol, 0x00001000, 9600, &e.channelID); err != nil {
-		return nil, fmt.Errorf("PassThruConnect: %w", err)
+	for p, limit := range DefaultQueueLimits {
+		e.outgoing[p] = make(chan message.Message, limit)
 	}
 
-	opts := &passthru.SCONFIG_LIST{
-		NumOfParams: 4,
-		Params: []passthru.SCONFIG{
-			{
-				Parameter: passthru.LOOPBACK,
-				Value:     0,
-			},
-			{
-				Parameter: passthru.PARITY,
-				Value:     1,
-			},
-			{
-				Parameter: passthru.DATA_BITS,
-				Value:     0,
-			},
-			{
-				Parameter: passthru.DATA_RATE,
-				Value:     9600,
-			},
-		},
-	}
-	if err := pt.PassThruIoctl(e.channelID, passthru.SET_CONFIG, opts, nil); err != nil {
-		return nil, fmt.Errorf("PassThruIoctl set options: %w", err)
+	if err := t.Open(); err != nil {
+		return nil, err
 	}
+	e.linkState.Store(int32(LinkUp))
 
-	e.h = pt
-
-	e.allowAll()
-
-	go e.handler()
-	go e.reader() // Start serial port reader
-	go e.writer() // Start serial port writer
-
-	return e, nil
-}
-
-func (e *Engine) allowAll() {
-	filterID := uint32(0)
-	maskMsg := &passthru.PassThruMsg{
-		ProtocolID: e.protocol,
-		DataSize:   1,
-		Data:       [4128]byte{0x00},
-	}
-	patternMsg := &passthru.PassThruMsg{
-		ProtocolID: e.protocol,
-		DataSize:   1,
-		Data:       [4128]byte{0x00},
-	}
-	if err := e.h.PassThruStartMsgFilter(e.channelID, passthru.PASS_FILTER, maskMsg, patternMsg, nil, &filterID); err != nil {
-		e.OnError(fmt.Errorf("PassThruStartMsgFilter: %w", err))
+	if caps := t.Capabilities(); caps.Echo {
+		e.echo = newEchoFilter(caps.EchoWindow)
 	}
-}
 
-func (e *Engine) Close() error {
-	close(e.outgoing)
-	close(e.quit)
-	time.Sleep(200 * time.Millisecond)
-	e.h.PassThruIoctl(e.channelID, passthru.CLEAR_MSG_FILTERS, nil, nil)
-	e.h.PassThruDisconnect(e.channelID)
-	e.h.PassThruClose(e.deviceID)
-	return e.h.Close()
-}
+	e.spawn(e.handler)
+	e.spawn(e.reader) // Start port reader
+	e.spawn(e.writer) // Start port writer
 
-func (e *Engine) Send(msg message.Message) error {
-	t := time.NewTimer(1 * time.Second)
-	defer t.Stop()
-	select {
-	case e.outgoing <- msg:
-	case <-t.C:
-		return fmt.Errorf("send buffer full")
-	}
-	return nil
+	return e, nil
 }
 
-func (e *Engine) SendAndRecv(timeout time.Duration, msg message.Message, identifiers ...uint8) (message.Message, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	sub, err := e.Subscribe(ctx, identifiers...)
+// SendAndRecv sends msg and returns the first message received that match accepts, or the ctx error.
+// The response subscriber is registered before msg is queued so a fast reply can not be missed.
+func (e *Engine) SendAndRecv(ctx context.Context, msg message.Message, match Matcher) (message.Message, error) {
+	sub, err := e.SubscribeFunc(ctx, match)
 	if err != nil {
 		return nil, err
 	}
 	defer sub.Close()
-	if err := e.Send(msg); err != nil {
+	written, err := e.sendTracked(ctx, msg)
+	if err != nil {
 		return nil, err
 	}
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case msg := <-sub.Chan():
-		return msg, nil
+	case resp, ok := <-sub.Chan():
+		if !ok {
+			if err := sub.Err(); err != nil {
+				return nil, err
+			}
+			return nil, ErrSubscriberClosed
+		}
+		e.observeResponse(ctx, msg, resp, written)
+		return resp, nil
 	}
 }
 
@@ -172,11 +163,16 @@ func (e *Engine) handler() {
 	for {
 		select {
 		case <-e.quit:
+			// nothing is sent to listeners any more, let them see the engine is gone
+			for l := range e.listeners {
+				delete(e.listeners, l)
+				l.close(ErrClosed)
+			}
 			return
 		case r := <-e.register:
 			e.listeners[r] = true
 		case r := <-e.unregister:
-			delete(e.listeners, r)
+			e.removeListener(r, nil)
 		case msg := <-e.incoming:
 			if e.OnIncoming != nil {
 				go e.OnIncoming(msg)
@@ -186,159 +182,193 @@ func (e *Engine) handler() {
 	}
 }
 
+// removeListener must only be called from the handler, which is the only sender on the callback channel
+func (e *Engine) removeListener(l *Subscriber, reason error) {
+	if _, found := e.listeners[l]; !found {
+		return
+	}
+	delete(e.listeners, l)
+	l.close(reason)
+	if reason != nil && e.OnEvict != nil {
+		go e.OnEvict(l, reason)
+	}
+}
+
 func (e *Engine) fanout(msg message.Message) {
 	for l := range e.listeners {
 		select {
 		case <-l.ctx.Done():
-			e.unregister <- l
+			e.removeListener(l, nil)
 			continue
 		default:
 		}
-		ids := l.GetIDFilter()
-		if len(ids) == 0 {
-			select {
-			case l.callback <- msg:
-			default:
-				l.errcount++
-			}
+		if !l.accepts(msg) {
 			continue
 		}
-		for _, id := range ids {
-			if l.errcount > 10 {
-				select {
-				case e.unregister <- l:
-				default:
-					panic("could not queue unregister")
-				}
-				break
-			}
-			if id == msg.ID() {
-				select {
-				case l.callback <- msg:
-				default:
-					l.errcount++
-				}
-			}
+		if !l.deliver(msg) {
+			e.removeListener(l, fmt.Errorf("%w: %d messages dropped (%s)", ErrSubscriberEvicted, l.Dropped(), l.opts.Overflow))
 		}
 	}
 }
 
-//var sendMutex = make(chan struct{}, 1)
-
 func (e *Engine) reader() {
+	failures := 0 // read errors in a row
 	for {
 		select {
 		case <-e.quit:
 			return
 		default:
 		}
-		msg, err := e.readMsg()
+		frame, err := e.t.ReadFrame()
+		if err != nil && e.isClosed() {
+			return
+		}
+		switch {
+		case err == nil:
+			failures = 0
+		case errors.Is(err, ErrLinkDown):
+		case errors.Is(err, ErrTransportClosed):
+			// closed underneath the engine, it has to be reopened before anything can be read again
+			err = linkDown(err)
+		case !isFrameError(err):
+			// an error that keeps coming back is not going away without reopening the transport
+			if failures++; failures >= DefaultReadErrorLimit {
+				err = linkDown(fmt.Errorf("%d read errors in a row: %w", failures, err))
+			}
+		}
+		if errors.Is(err, ErrLinkDown) {
+			failures = 0
+			if !e.recover(err) {
+				return
+			}
+			continue
+		}
 		if err != nil {
+			e.stats.readErrors.Add(1)
 			e.OnError(err)
-			continue
 		}
-		if msg == nil {
+		if frame.Received.IsZero() {
+			frame.Received = time.Now()
+		}
+		if e.echo != nil {
+			e.reportCollisions(e.echo.expire(frame.Received))
+		}
+		if len(frame.Data) == 0 {
 			continue
 		}
-		if msg.DataSize == 0 {
-
-			//e.OnError(fmt.Errorf("empty message received: %08X", msg.RxStatus))
+		if e.echo != nil {
+			echo, unmatched := e.echo.match(frame.Data, frame.Received)
+			e.reportCollisions(unmatched)
+			if echo != nil {
+				echo.Status = TxConfirmed
+				echo.Confirmed = frame.Received
+				echo.RxStatus = frame.RxStatus
+				echo.Timestamp = frame.Timestamp
+				e.notifyOutgoing(echo)
+				continue
+			}
+			if tx := e.echo.lateEcho(frame.Data, frame.Received); tx != nil {
+				// already reported unconfirmed, delivered it could pass as the reply to itself
+				e.OnError(fmt.Errorf("%w: %X read back after %s, dropped", ErrLateEcho, frame.Data, frame.Received.Sub(tx.Written).Round(time.Millisecond)))
+				continue
+			}
+		}
+		if frame.RxStatus&RxStatusTxMsg != 0 {
+			// a transmission the adapter read back that no longer matches anything pending
 			continue
 		}
 
-		m, err := message.NewFromBytes(msg.Data[:msg.DataSize])
+		m, err := message.NewFromBytes(frame.Data)
 		if err != nil {
 			e.OnError(err)
 			continue
 		}
-		e.incoming <- m
-	}
-}
-
-func (e *Engine) readMsg() (*passthru.PassThruMsg, error) {
-	msg := &passthru.PassThruMsg{
-		ProtocolID: e.protocol,
-	}
-	if err := e.h.PassThruReadMsgs(e.channelID, uintptr(unsafe.Pointer(msg)), 1, 0); err != nil {
-		if errors.Is(err, passthru.ErrBufferEmpty) {
-			return nil, nil
-		}
-		if errors.Is(err, passthru.ErrDeviceNotConnected) {
-			return nil, fmt.Errorf("device not connected: %w", err)
+		e.stats.in(m)
+		select {
+		case e.incoming <- &RxMsg{
+			Message:   m,
+			RxStatus:  frame.RxStatus,
+			Timestamp: frame.Timestamp,
+			Received:  frame.Received,
+		}:
+		case <-e.quit:
+			return
 		}
-		return nil, fmt.Errorf("read error: %w", err)
 	}
-	return msg, nil
 }
 
 func (e *Engine) writer() {
-	for msg := range e.outgoing {
-		if msg == nil {
-			e.OnError(errors.New("got nil message, closing writer"))
-			break
+	for {
+		msg, ok := e.nextOutgoing()
+		if !ok {
+			return
 		}
-		msg.Bytes()
-		fmsg := &passthru.PassThruMsg{
-			ProtocolID: e.protocol,
-			DataSize:   uint32(len(msg.Bytes())),
-			TxFlags:    0,
+		var written chan time.Time
+		if t, ok := msg.(*trackedMsg); ok {
+			msg, written = t.Message, t.written
 		}
-		copy(fmsg.Data[:], msg.Bytes())
-		if err := e.sendMsg(fmsg); err != nil {
-			e.OnError(err)
+		if e.echo != nil {
+			e.filterTx(msg.ID())
 		}
-
-		if e.OnOutgoing != nil {
-			go e.OnOutgoing(msg)
+		tx := &TxMsg{Message: msg, Written: time.Now()}
+		err := e.write(tx)
+		if written != nil {
+			if err == nil {
+				written <- tx.Written
+			}
+			close(written)
+		}
+		if err != nil {
+			e.stats.writeErrors.Add(1)
+			// the reader notices a dead link and recovers it, frames sent meanwhile are dropped
+			if !errors.Is(err, ErrLinkDown) && !e.isClosed() {
+				e.OnError(err)
+			}
+			continue
 		}
 
-	}
-}
-
-func (e *Engine) sendMsg(msg *passthru.PassThruMsg) error {
-	if err := e.h.PassThruWriteMsgs(e.channelID, uintptr(unsafe.Pointer(msg)), 1, 0); err != nil {
-		if errStr, err2 := e.h.PassThruGetLastError(); err2 == nil {
-			return fmt.Errorf("%w: %s", err, errStr)
+		e.stats.out(msg)
+		if e.echo == nil {
+			e.notifyOutgoing(tx)
 		}
-		return err
 	}
-	return nil
 }
 
-func getPacketSize(b byte) int {
-	return int(1 + (b & 0x0f))
+// notifyOutgoing hands tx to OnOutgoing, on transports that read back their own frames once the echo settled its status
+func (e *Engine) notifyOutgoing(tx *TxMsg) {
+	if e.OnOutgoing != nil {
+		go e.OnOutgoing(tx)
+	}
 }
 
-/*
-func (e *Engine) processMessage(data []byte) {
-	packet := make([]byte, len(data))
-	copy(packet, data)
-
-	msg, err := message.NewFromBytes(packet)
-	if err != nil {
-		e.OnError(err)
-		return
+func (e *Engine) write(tx *TxMsg) error {
+	e.tmu.RLock()
+	defer e.tmu.RUnlock()
+	if e.LinkState() != LinkUp {
+		return ErrLinkDown
 	}
-	last := make([]byte, len(packet))
-	if _, err := e.loopback.TryRead(last); err != nil {
-		if err != ringbuffer.ErrIsEmpty {
-			e.OnError(err)
+	// the echo can be read back before WriteFrame returns, so record it first
+	if e.echo != nil {
+		e.echo.sent(tx)
+	}
+	if err := e.t.WriteFrame(tx.Bytes()); err != nil {
+		if e.echo != nil {
+			e.echo.forget(tx)
 		}
+		return err
 	}
+	return nil
+}
 
-	if bytes.Equal(last, packet) {
-		return
+func (e *Engine) reportCollisions(unmatched []*TxMsg) {
+	e.stats.collisions.Add(uint64(len(unmatched)))
+	for _, tx := range unmatched {
+		e.OnError(fmt.Errorf("%w: no echo for %X", ErrPossibleCollision, tx.Bytes()))
+		tx.Status = TxUnconfirmed
+		e.notifyOutgoing(tx)
 	}
+}
 
-	//select {
-	//case <-sendMutex:
-	//default:
-	//}
-
-	select {
-	case e.incoming <- msg:
-	default:
-		e.OnError(fmt.Errorf("incomming buffer full, discarded: %s", msg.String()))
-	}
+func getPacketSize(b byte) int {
+	return int(1 + (b & 0x0f))
 }
-*/
@@ -0,0 +1,104 @@
+package kline
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrClosed is returned by every Engine method once Close has been called
+var ErrClosed = errors.New("engine closed")
+
+// CloseError collects every failure while shutting down
+type CloseError []error
+
+func (e CloseError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e CloseError) Unwrap() []error {
+	return e
+}
+
+// Is reports if any of the collected errors matches target
+func (e CloseError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeErrors returns nil, the only error or a CloseError with the non-nil errs
+func closeErrors(errs ...error) error {
+	var ce CloseError
+	for _, err := range errs {
+		if err != nil {
+			ce = append(ce, err)
+		}
+	}
+	switch len(ce) {
+	case 0:
+		return nil
+	case 1:
+		return ce[0]
+	}
+	return ce
+}
+
+// Close stops the engine, closes the transport and waits for its goroutines to return.
+// The transport is closed first so a reader or writer blocked on it returns. Subscriber channels are closed, and Close
+// returns ErrClosed when called again.
+func (e *Engine) Close() error {
+	e.lifeMu.Lock()
+	if e.closed {
+		e.lifeMu.Unlock()
+		return ErrClosed
+	}
+	e.closed = true
+	close(e.quit)
+	e.lifeMu.Unlock()
+
+	// not under e.tmu, a write blocked on the transport holds it until the transport is closed
+	err := e.t.Close()
+
+	e.wg.Wait()
+	// a reconnect that was reopening the transport meanwhile has opened it again
+	err2 := e.t.Close()
+	close(e.done)
+	return closeErrors(err, err2)
+}
+
+// Done is closed once Close has stopped every goroutine and closed the transport
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// isClosed reports if Close has been called
+func (e *Engine) isClosed() bool {
+	select {
+	case <-e.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// spawn runs fn in a goroutine Close waits for, it returns false without running fn once the engine is closed
+func (e *Engine) spawn(fn func()) bool {
+	e.lifeMu.Lock()
+	defer e.lifeMu.Unlock()
+	if e.closed {
+		return false
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		fn()
+	}()
+	return true
+}
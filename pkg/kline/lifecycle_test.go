@@ -0,0 +1,149 @@
+package kline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// blockingRW reads from an io.Pipe, it has no read deadline so only closing it ends a blocked read
+type blockingRW struct {
+	*io.PipeReader
+	w *io.PipeWriter
+}
+
+func newBlockingRW() *blockingRW {
+	r, w := io.Pipe()
+	return &blockingRW{PipeReader: r, w: w}
+}
+
+func (b *blockingRW) Write(p []byte) (int, error) { return len(p), nil }
+
+// closeWithin fails t if e.Close takes longer than d
+func closeWithin(t *testing.T, e *Engine, d time.Duration) error {
+	t.Helper()
+	res := make(chan error, 1)
+	go func() { res <- e.Close() }()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(d):
+		t.Fatal("Close hangs")
+		return nil
+	}
+}
+
+func TestCloseUnblocksReader(t *testing.T) {
+	e, err := NewWithTransport(NewStreamTransport("blocking", newBlockingRW(), DefaultStreamConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeWithin(t, e, time.Second); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if err := e.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("second close: %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestCloseWhileReconnecting(t *testing.T) {
+	rw := newBlockingRW()
+	states := make(chan LinkState, 8)
+	e, err := NewWithOptions(NewStreamTransport("blocking", rw, DefaultStreamConfig), Options{
+		OnError:     func(err error) {},
+		OnLinkState: func(s LinkState) { states <- s },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer going away takes the link down, recovering closes the transport and can not reopen it
+	rw.w.Close()
+	select {
+	case <-states:
+	case <-time.After(time.Second):
+		t.Fatal("link did not go down")
+	}
+	if err := closeWithin(t, e, time.Second); err != nil {
+		t.Errorf("close: %v", err)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	a, _ := NewPipe()
+	e, err := NewWithTransport(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	if err := e.Send(context.Background(), nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("send nil after close: %v, want %v", err, ErrClosed)
+	}
+	if err := e.SendPriority(context.Background(), -1, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("send invalid priority after close: %v, want %v", err, ErrClosed)
+	}
+}
+
+// stuckWriter is a pipe end whose writes block until it is closed, like a serial port whose buffer never drains
+type stuckWriter struct {
+	Transport
+	closed  chan struct{}
+	writing chan struct{}
+}
+
+func (s *stuckWriter) WriteFrame(frame []byte) error {
+	close(s.writing)
+	<-s.closed
+	return ErrTransportClosed
+}
+
+func (s *stuckWriter) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return s.Transport.Close()
+}
+
+func TestCloseUnblocksWriter(t *testing.T) {
+	a, _ := NewPipe()
+	tr := &stuckWriter{Transport: a, closed: make(chan struct{}), writing: make(chan struct{})}
+	e, err := NewWithTransport(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Send(context.Background(), message.New(2, []byte{0x01})); err != nil {
+		t.Fatal(err)
+	}
+	<-tr.writing
+	if err := closeWithin(t, e, time.Second); err != nil {
+		t.Errorf("close: %v", err)
+	}
+}
+
+func TestClosedEngine(t *testing.T) {
+	a, _ := NewPipe()
+	e, err := NewWithTransport(&filterPipe{Transport: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	errs := map[string]error{
+		"FilterFrames": e.FilterFrames(),
+		"PollVoltage":  e.PollVoltage(0),
+		"CheckVoltage": e.CheckVoltage(12),
+		"Periodic.Err": e.AddPeriodic(message.New(2, []byte{0x01}), PeriodicConfig{Period: time.Second}).Err(),
+	}
+	_, errs["AdapterInfo"] = e.AdapterInfo()
+	_, errs["Subscribe"] = e.Subscribe(context.Background(), 2)
+	for name, err := range errs {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after close: %v, want %v", name, err, ErrClosed)
+		}
+	}
+}
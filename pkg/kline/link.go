@@ -0,0 +1,129 @@
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// ErrLinkDown is matched by errors.Is for transport errors the link does not recover from without reopening the device
+var ErrLinkDown = errors.New("link down")
+
+// LinkError marks a transport error as fatal for the link
+type LinkError struct {
+	Err error
+}
+
+func linkDown(err error) error {
+	return &LinkError{Err: err}
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrLinkDown, e.Err)
+}
+
+func (e *LinkError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LinkError) Is(target error) bool {
+	return target == ErrLinkDown
+}
+
+type LinkState int32
+
+const (
+	LinkConnecting LinkState = iota
+	LinkUp
+	LinkFaulted
+	LinkReconnecting
+)
+
+func (s LinkState) String() string {
+	switch s {
+	case LinkConnecting:
+		return "connecting"
+	case LinkUp:
+		return "up"
+	case LinkFaulted:
+		return "faulted"
+	case LinkReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	DefaultReconnectMin = 250 * time.Millisecond
+	DefaultReconnectMax = 5 * time.Second
+	// DefaultReadErrorLimit is how many read errors in a row take the link down, bad frames do not count
+	DefaultReadErrorLimit = 5
+)
+
+// isFrameError reports if err is about a single bad frame rather than the transport
+func isFrameError(err error) bool {
+	var ce *message.ChecksumError
+	return errors.As(err, &ce)
+}
+
+func (e *Engine) LinkState() LinkState {
+	return LinkState(e.linkState.Load())
+}
+
+func (e *Engine) setLinkState(s LinkState) {
+	if LinkState(e.linkState.Swap(int32(s))) == s {
+		return
+	}
+	if e.OnLinkState != nil {
+		e.OnLinkState(s)
+	}
+}
+
+// recover reopens the transport with exponential backoff until it succeeds or the engine is closed
+func (e *Engine) recover(cause error) bool {
+	e.setLinkState(LinkFaulted)
+	e.OnError(cause)
+
+	e.tmu.Lock()
+	e.t.Close()
+	e.tmu.Unlock()
+
+	backoff := e.ReconnectMin
+	for {
+		select {
+		case <-e.quit:
+			return false
+		case <-time.After(backoff):
+		}
+		e.setLinkState(LinkReconnecting)
+		if e.reopen() {
+			e.restoreFilter()
+			e.setLinkState(LinkUp)
+			return true
+		}
+		backoff *= 2
+		if backoff > e.ReconnectMax {
+			backoff = e.ReconnectMax
+		}
+	}
+}
+
+func (e *Engine) reopen() bool {
+	e.tmu.Lock()
+	defer e.tmu.Unlock()
+	if e.isClosed() {
+		// Close has closed the transport already
+		return false
+	}
+	if err := e.t.Open(); err != nil {
+		return false
+	}
+	if e.echo != nil {
+		e.echo.reset()
+	}
+	e.restartPeriodics()
+	return true
+}
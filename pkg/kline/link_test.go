@@ -0,0 +1,124 @@
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// failingTransport fails every read with err
+type failingTransport struct {
+	err   error
+	opens atomic.Int32
+}
+
+func (f *failingTransport) Open() error {
+	f.opens.Add(1)
+	return nil
+}
+
+func (f *failingTransport) ReadFrame() (Frame, error) {
+	time.Sleep(time.Millisecond)
+	return Frame{}, f.err
+}
+
+func (f *failingTransport) WriteFrame(frame []byte) error { return nil }
+func (f *failingTransport) Close() error                  { return nil }
+func (f *failingTransport) Capabilities() Capabilities    { return Capabilities{Name: "failing"} }
+
+// linkRecorder collects the link states and counts the errors of an engine
+type linkRecorder struct {
+	mu     sync.Mutex
+	states []LinkState
+	errors int
+}
+
+func (r *linkRecorder) options() Options {
+	return Options{
+		OnError: func(err error) {
+			r.mu.Lock()
+			r.errors++
+			r.mu.Unlock()
+		},
+		OnLinkState: func(s LinkState) {
+			r.mu.Lock()
+			r.states = append(r.states, s)
+			r.mu.Unlock()
+		},
+	}
+}
+
+func (r *linkRecorder) result() ([]LinkState, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LinkState(nil), r.states...), r.errors
+}
+
+func TestPeerClosedTakesLinkDown(t *testing.T) {
+	a, b := NewPipe()
+	var r linkRecorder
+	e, err := NewWithOptions(a, r.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	if s := e.LinkState(); s == LinkUp {
+		t.Errorf("link state %s with the peer closed", s)
+	}
+	states, errs := r.result()
+	if len(states) == 0 || states[0] != LinkFaulted {
+		t.Errorf("link states %v, want %s first", states, LinkFaulted)
+	}
+	// one for the fault, reopening a closed pipe fails quietly
+	if errs > 2 {
+		t.Errorf("%d errors reported in 200ms", errs)
+	}
+	e.Close()
+}
+
+func TestRepeatedReadErrorsReconnect(t *testing.T) {
+	ft := &failingTransport{err: errors.New("adapter gone")}
+	var r linkRecorder
+	e, err := NewWithOptions(ft, r.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	e.Close()
+
+	states, errs := r.result()
+	if len(states) == 0 || states[0] != LinkFaulted {
+		t.Fatalf("link states %v, want %s first", states, LinkFaulted)
+	}
+	// the errors before the limit and the one taking the link down
+	if errs != DefaultReadErrorLimit {
+		t.Errorf("%d errors reported, want %d", errs, DefaultReadErrorLimit)
+	}
+	if n := ft.opens.Load(); n != 1 {
+		t.Errorf("transport opened %d times before the first reconnect attempt", n)
+	}
+}
+
+func TestChecksumErrorsKeepLinkUp(t *testing.T) {
+	ft := &failingTransport{err: fmt.Errorf("serial read: %w", &message.ChecksumError{Frame: []byte{0x22, 0x03, 0x15}, Received: 0x3b, Expected: 0x3a})}
+	var r linkRecorder
+	e, err := NewWithOptions(ft, r.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := e.LinkState(); s != LinkUp {
+		t.Errorf("link state %s after bad frames", s)
+	}
+	e.Close()
+	if states, _ := r.result(); len(states) != 0 {
+		t.Errorf("link states %v after bad frames", states)
+	}
+}
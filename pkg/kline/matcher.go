@@ -0,0 +1,72 @@
+package kline
+
+import "github.com/roffe/ismtool/pkg/message"
+
+// Matcher reports if msg is the response a caller is waiting for
+type Matcher interface {
+	Match(msg message.Message) bool
+}
+
+// IDMatcher is implemented by matchers that only accept messages with one of the ids returned by IDs,
+// the hardware filter passes just those ids for their subscriber instead of every id
+type IDMatcher interface {
+	Matcher
+	IDs() []uint8
+}
+
+// MatchFunc is a Matcher that accepts the messages f returns true for, its subscriber needs every id
+type MatchFunc func(msg message.Message) bool
+
+func (f MatchFunc) Match(msg message.Message) bool {
+	return f(msg)
+}
+
+// idMatcher accepts the messages with one of ids, and if commands is set only those whose first data byte is one of commands
+type idMatcher struct {
+	ids      []uint8
+	commands []byte
+}
+
+// MatchID matches messages with one of identifiers
+func MatchID(identifiers ...uint8) Matcher {
+	return &idMatcher{ids: identifiers}
+}
+
+// MatchCommand matches messages with identifier id whose first data byte is one of commands,
+// the transponder answers on id 2 with the subcommand of the request as first byte
+func MatchCommand(id uint8, commands ...byte) Matcher {
+	// not nil, without commands nothing matches
+	return &idMatcher{ids: []uint8{id}, commands: append([]byte{}, commands...)}
+}
+
+func (m *idMatcher) IDs() []uint8 {
+	return m.ids
+}
+
+func (m *idMatcher) Match(msg message.Message) bool {
+	if !m.matchID(msg.ID()) {
+		return false
+	}
+	if m.commands == nil {
+		return true
+	}
+	data := msg.Data()
+	if len(data) == 0 {
+		return false
+	}
+	for _, cmd := range m.commands {
+		if data[0] == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *idMatcher) matchID(id uint8) bool {
+	for _, want := range m.ids {
+		if id == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package kline
+
+import "errors"
+
+// passthruAPI is the part of the J2534 DLL the transport uses,
+// the j2534 transport only talks to it through this interface so a fake adapter can stand in for the DLL
+type passthruAPI interface {
+	PassThruOpen(deviceName string, pDeviceID *uint32) error
+	PassThruClose(deviceID uint32) error
+	PassThruConnect(deviceID uint32, protocolID uint32, flags uint32, baudRate uint32, pChannelID *uint32) error
+	PassThruDisconnect(channelID uint32) error
+	PassThruReadMsgs(channelID uint32, pMsg *passThruMsg, pNumMsgs uint32, timeout uint32) error
+	PassThruWriteMsgs(channelID uint32, pMsg *passThruMsg, pNumMsgs uint32, timeout uint32) error
+	PassThruStartMsgFilter(channelID uint32, filterType uint32, pMaskMsg, pPatternMsg, pFlowControlMsg *passThruMsg, pFilterID *uint32) error
+	PassThruStopMsgFilter(channelID uint32, filterID uint32) error
+	PassThruIoctl(handleID uint32, ioctlID uint32, pInput *sconfigList, pOutput *uint32) error
+	PassThruGetLastError() (string, error)
+	PassThruReadVersion(deviceID uint32) (firmware, dll, api string, err error)
+	PassThruStartPeriodicMsg(channelID uint32, pMsg *passThruMsg, pMsgID *uint32, interval uint32) error
+	PassThruStopPeriodicMsg(channelID uint32, msgID uint32) error
+	Close() error
+}
+
+// passThruMsg is the J2534 PASSTHRU_MSG
+type passThruMsg struct {
+	ProtocolID     uint32
+	RxStatus       uint32
+	TxFlags        uint32
+	Timestamp      uint32 // adapter time in microseconds
+	DataSize       uint32
+	ExtraDataIndex uint32
+	Data           [4128]byte
+}
+
+type sconfig struct {
+	Parameter uint32
+	Value     uint32
+}
+
+// sconfigList is the J2534 SCONFIG_LIST, GET_CONFIG fills in the values of Params
+type sconfigList struct {
+	NumOfParams uint32
+	Params      []sconfig
+}
+
+// J2534 filter types, ioctl ids and SCONFIG parameters the transport uses
+const (
+	passFilter  = 0x01
+	blockFilter = 0x02
+
+	ioctlGetConfig         = 0x01
+	ioctlSetConfig         = 0x02
+	ioctlReadVBatt         = 0x03
+	ioctlClearPeriodicMsgs = 0x09
+	ioctlClearMsgFilters   = 0x0a
+
+	paramDataRate = 0x01
+	paramLoopback = 0x03
+	paramP1Max    = 0x07
+	paramP3Min    = 0x0a
+	paramP4Min    = 0x0c
+	paramParity   = 0x16
+	paramDataBits = 0x20
+)
+
+// J2534 status codes the transport acts on, the DLL binding returns errors that match them with errors.Is
+var (
+	errPassThruNotSupported       = errors.New("ERR_NOT_SUPPORTED")
+	errPassThruDeviceNotConnected = errors.New("ERR_DEVICE_NOT_CONNECTED")
+	errPassThruTimeout            = errors.New("ERR_TIMEOUT")
+	errPassThruBufferEmpty        = errors.New("ERR_BUFFER_EMPTY")
+	errPassThruInvalidIoctlID     = errors.New("ERR_INVALID_IOCTL_ID")
+	errPassThruInvalidMsgID       = errors.New("ERR_INVALID_MSG_ID")
+	errPassThruInvalidFilterID    = errors.New("ERR_INVALID_FILTER_ID")
+)
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package kline
+
+import "errors"
+
+var errJ2534NotSupported = errors.New("J2534 adapters are only supported on windows")
+
+// loadPassthru fails, J2534 needs the windows DLL
+func loadPassthru(dllName string) (passthruAPI, error) {
+	return nil, errJ2534NotSupported
+}
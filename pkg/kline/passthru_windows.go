@@ -0,0 +1,180 @@
+//go:build windows
+
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/roffe/gocan/adapter/passthru"
+)
+
+// passthruDLL binds passthruAPI to the J2534 DLL through gocan, and adds the periodic message and stop filter calls
+// gocan does not wrap
+type passthruDLL struct {
+	pt                       *passthru.PassThru
+	dll                      *syscall.DLL
+	passThruStartPeriodicMsg *syscall.Proc
+	passThruStopPeriodicMsg  *syscall.Proc
+	passThruStopMsgFilter    *syscall.Proc
+}
+
+func loadPassthru(dllName string) (passthruAPI, error) {
+	pt, err := passthru.NewJ2534(dllName)
+	if err != nil {
+		return nil, err
+	}
+	dll, err := syscall.LoadDLL(dllName)
+	if err != nil {
+		pt.Close()
+		return nil, err
+	}
+	start, err := dll.FindProc("PassThruStartPeriodicMsg")
+	if err != nil {
+		dll.Release()
+		pt.Close()
+		return nil, err
+	}
+	stop, err := dll.FindProc("PassThruStopPeriodicMsg")
+	if err != nil {
+		dll.Release()
+		pt.Close()
+		return nil, err
+	}
+	stopFilter, err := dll.FindProc("PassThruStopMsgFilter")
+	if err != nil {
+		dll.Release()
+		pt.Close()
+		return nil, err
+	}
+	return &passthruDLL{
+		pt:                       pt,
+		dll:                      dll,
+		passThruStartPeriodicMsg: start,
+		passThruStopPeriodicMsg:  stop,
+		passThruStopMsgFilter:    stopFilter,
+	}, nil
+}
+
+// passthruErrors maps the gocan errors the transport acts on to the ones it checks for
+var passthruErrors = []struct{ gocan, kline error }{
+	{passthru.ErrNotSupported, errPassThruNotSupported},
+	{passthru.ErrDeviceNotConnected, errPassThruDeviceNotConnected},
+	{passthru.ErrTimeout, errPassThruTimeout},
+	{passthru.ErrBufferEmpty, errPassThruBufferEmpty},
+	{passthru.ErrInvalidIoctlID, errPassThruInvalidIoctlID},
+	{passthru.ErrInvalidMsgID, errPassThruInvalidMsgID},
+	{passthru.ErrInvalidFilterID, errPassThruInvalidFilterID},
+}
+
+func passthruError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, e := range passthruErrors {
+		if errors.Is(err, e.gocan) {
+			return fmt.Errorf("%w: %v", e.kline, err)
+		}
+	}
+	return err
+}
+
+// gocanMsg returns msg as gocan's PassThruMsg, both have the PASSTHRU_MSG layout
+func gocanMsg(msg *passThruMsg) *passthru.PassThruMsg {
+	return (*passthru.PassThruMsg)(unsafe.Pointer(msg))
+}
+
+func (p *passthruDLL) PassThruOpen(deviceName string, pDeviceID *uint32) error {
+	return passthruError(p.pt.PassThruOpen(deviceName, pDeviceID))
+}
+
+func (p *passthruDLL) PassThruClose(deviceID uint32) error {
+	return passthruError(p.pt.PassThruClose(deviceID))
+}
+
+func (p *passthruDLL) PassThruConnect(deviceID uint32, protocolID uint32, flags uint32, baudRate uint32, pChannelID *uint32) error {
+	return passthruError(p.pt.PassThruConnect(deviceID, protocolID, flags, baudRate, pChannelID))
+}
+
+func (p *passthruDLL) PassThruDisconnect(channelID uint32) error {
+	return passthruError(p.pt.PassThruDisconnect(channelID))
+}
+
+func (p *passthruDLL) PassThruReadMsgs(channelID uint32, pMsg *passThruMsg, pNumMsgs uint32, timeout uint32) error {
+	return passthruError(p.pt.PassThruReadMsgs(channelID, uintptr(unsafe.Pointer(pMsg)), pNumMsgs, timeout))
+}
+
+func (p *passthruDLL) PassThruWriteMsgs(channelID uint32, pMsg *passThruMsg, pNumMsgs uint32, timeout uint32) error {
+	return passthruError(p.pt.PassThruWriteMsgs(channelID, uintptr(unsafe.Pointer(pMsg)), pNumMsgs, timeout))
+}
+
+func (p *passthruDLL) PassThruStartMsgFilter(channelID uint32, filterType uint32, pMaskMsg, pPatternMsg, pFlowControlMsg *passThruMsg, pFilterID *uint32) error {
+	var flowControl *passthru.PassThruMsg
+	if pFlowControlMsg != nil {
+		flowControl = gocanMsg(pFlowControlMsg)
+	}
+	return passthruError(p.pt.PassThruStartMsgFilter(channelID, filterType, gocanMsg(pMaskMsg), gocanMsg(pPatternMsg), flowControl, pFilterID))
+}
+
+func (p *passthruDLL) PassThruIoctl(handleID uint32, ioctlID uint32, pInput *sconfigList, pOutput *uint32) error {
+	var list *passthru.SCONFIG_LIST
+	if pInput != nil {
+		list = &passthru.SCONFIG_LIST{NumOfParams: pInput.NumOfParams, Params: make([]passthru.SCONFIG, len(pInput.Params))}
+		for i, c := range pInput.Params {
+			list.Params[i] = passthru.SCONFIG{Parameter: c.Parameter, Value: c.Value}
+		}
+	}
+	err := p.pt.PassThruIoctl(handleID, ioctlID, list, (*byte)(unsafe.Pointer(pOutput)))
+	if list != nil {
+		// GET_CONFIG returns the values in the list
+		for i := range pInput.Params {
+			pInput.Params[i].Value = list.Params[i].Value
+		}
+	}
+	return passthruError(err)
+}
+
+func (p *passthruDLL) PassThruGetLastError() (string, error) {
+	return p.pt.PassThruGetLastError()
+}
+
+func (p *passthruDLL) PassThruReadVersion(deviceID uint32) (string, string, string, error) {
+	fw, dll, api, err := p.pt.PassThruReadVersion(deviceID)
+	return fw, dll, api, passthruError(err)
+}
+
+func (p *passthruDLL) PassThruStartPeriodicMsg(channelID uint32, pMsg *passThruMsg, pMsgID *uint32, interval uint32) error {
+	// long PassThruStartPeriodicMsg(unsigned long ChannelID, PASSTHRU_MSG *pMsg, unsigned long *pMsgID, unsigned long TimeInterval);
+	ret, _, _ := p.passThruStartPeriodicMsg.Call(
+		uintptr(channelID),
+		uintptr(unsafe.Pointer(pMsg)),
+		uintptr(unsafe.Pointer(pMsgID)),
+		uintptr(interval),
+	)
+	return passthruError(passthru.CheckError(ret))
+}
+
+func (p *passthruDLL) PassThruStopPeriodicMsg(channelID uint32, msgID uint32) error {
+	// long PassThruStopPeriodicMsg(unsigned long ChannelID, unsigned long MsgID);
+	ret, _, _ := p.passThruStopPeriodicMsg.Call(
+		uintptr(channelID),
+		uintptr(msgID),
+	)
+	return passthruError(passthru.CheckError(ret))
+}
+
+func (p *passthruDLL) PassThruStopMsgFilter(channelID uint32, filterID uint32) error {
+	// long PassThruStopMsgFilter(unsigned long ChannelID, unsigned long FilterID);
+	ret, _, _ := p.passThruStopMsgFilter.Call(
+		uintptr(channelID),
+		uintptr(filterID),
+	)
+	return passthruError(passthru.CheckError(ret))
+}
+
+func (p *passthruDLL) Close() error {
+	p.dll.Release()
+	return p.pt.Close()
+}
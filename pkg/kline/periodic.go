@@ -0,0 +1,309 @@
+package kline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// PeriodicConfig describes how often a periodic frame is sent
+type PeriodicConfig struct {
+	// Period is the interval between sends, zero sends the frame only when triggered
+	Period time.Duration
+	// Jitter adds a random delay of up to Jitter to every period
+	Jitter time.Duration
+	// MinInterval is the shortest gap between two sends of the frame, triggered sends included
+	MinInterval time.Duration
+	// Generate builds the frame for every send when set, the payload is used otherwise
+	Generate func() message.Message
+	// Priority is the outgoing queue the frame is sent through, the adapter sends offloaded frames by itself
+	Priority Priority
+}
+
+// Periodic is a frame the Engine sends on its own, see Engine.AddPeriodic
+type Periodic struct {
+	e   *Engine
+	cfg PeriodicConfig
+
+	payload atomic.Value // message.Message
+	paused  atomic.Bool
+
+	// offload is set when the adapter sends the frame instead of a timer
+	offload   PeriodicTransport
+	mu        sync.Mutex // guards adapterID and running, taken after e.tmu
+	adapterID uint32
+	running   bool
+
+	trigger  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// AddPeriodic starts sending msg according to cfg until Stop is called or the engine is closed.
+// A fixed frame with a fixed period is handed to the adapter if the transport is a PeriodicTransport.
+// Once the engine is closed the Periodic returned is stopped and its Err is ErrClosed.
+func (e *Engine) AddPeriodic(msg message.Message, cfg PeriodicConfig) *Periodic {
+	p := &Periodic{
+		e:       e,
+		cfg:     cfg,
+		trigger: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	p.payload.Store(msgBox{msg})
+	if e.isClosed() {
+		p.stopOnce.Do(func() { close(p.stop) })
+		return p
+	}
+
+	e.tmu.RLock()
+	pt, ok := e.t.(PeriodicTransport)
+	if ok && msg != nil && cfg.Period > 0 && cfg.Jitter == 0 && cfg.Generate == nil {
+		p.offload = pt
+		p.mu.Lock()
+		err := p.adapterStart()
+		p.mu.Unlock()
+		if err == nil {
+			e.pmu.Lock()
+			e.periodics[p] = true
+			e.pmu.Unlock()
+			e.tmu.RUnlock()
+			e.spawn(p.runTriggers)
+			return p
+		}
+		p.offload = nil
+		if e.isClosed() {
+			// closed while scheduling, there is no adapter to fall back from
+			e.tmu.RUnlock()
+			return p
+		}
+		e.OnError(fmt.Errorf("periodic %X: adapter scheduling failed, using a timer: %w", msg.Bytes(), err))
+	}
+	e.tmu.RUnlock()
+
+	e.spawn(p.run)
+	return p
+}
+
+// msgBox lets atomic.Value hold a nil message and messages of different concrete types
+type msgBox struct{ msg message.Message }
+
+// SetPayload replaces the frame sent from the next send on
+func (p *Periodic) SetPayload(msg message.Message) {
+	p.payload.Store(msgBox{msg})
+	p.adapter(func() error {
+		if err := p.adapterStop(); err != nil {
+			return err
+		}
+		if p.paused.Load() {
+			return nil
+		}
+		return p.adapterStart()
+	})
+}
+
+func (p *Periodic) Pause() {
+	p.paused.Store(true)
+	p.adapter(p.adapterStop)
+}
+
+func (p *Periodic) Resume() {
+	p.paused.Store(false)
+	p.adapter(func() error {
+		if p.running {
+			return nil
+		}
+		return p.adapterStart()
+	})
+}
+
+func (p *Periodic) Paused() bool {
+	return p.paused.Load()
+}
+
+// Err returns ErrClosed once the engine is closed and the frame is no longer sent, nil before
+func (p *Periodic) Err() error {
+	if p.e.isClosed() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Trigger sends the frame as soon as MinInterval allows, several triggers in between result in one send
+func (p *Periodic) Trigger() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Stop removes the frame from the schedule
+func (p *Periodic) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		if p.offload == nil {
+			return
+		}
+		p.e.pmu.Lock()
+		delete(p.e.periodics, p)
+		p.e.pmu.Unlock()
+		p.adapter(p.adapterStop)
+	})
+}
+
+// adapter runs fn for a frame scheduled on the adapter, a failure while the link is down is left to the restart after reconnect
+func (p *Periodic) adapter(fn func() error) {
+	if p.offload == nil || p.e.isClosed() {
+		// closing the transport cleared what the adapter sends
+		return
+	}
+	p.e.tmu.RLock()
+	defer p.e.tmu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := fn(); err != nil && !errors.Is(err, ErrLinkDown) {
+		p.e.OnError(fmt.Errorf("periodic: %w", err))
+	}
+}
+
+// adapterStart must be called with p.mu held
+func (p *Periodic) adapterStart() error {
+	msg := p.payload.Load().(msgBox).msg
+	if msg == nil {
+		return nil
+	}
+	id, err := p.offload.StartPeriodic(msg.Bytes(), p.cfg.Period)
+	if err != nil {
+		return err
+	}
+	p.adapterID, p.running = id, true
+	return nil
+}
+
+// adapterStop must be called with p.mu held
+func (p *Periodic) adapterStop() error {
+	if !p.running {
+		return nil
+	}
+	p.running = false
+	return p.offload.StopPeriodic(p.adapterID)
+}
+
+// restartPeriodics schedules the offloaded frames again after the transport was reopened, e.tmu must be held
+func (e *Engine) restartPeriodics() {
+	e.pmu.Lock()
+	defer e.pmu.Unlock()
+	for p := range e.periodics {
+		p.mu.Lock()
+		p.running = false
+		if !p.paused.Load() {
+			if err := p.adapterStart(); err != nil {
+				e.OnError(fmt.Errorf("periodic: restart: %w", err))
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// runTriggers sends an offloaded frame once when triggered, the adapter takes care of the period
+func (p *Periodic) runTriggers() {
+	for {
+		select {
+		case <-p.e.quit:
+			return
+		case <-p.stop:
+			return
+		case <-p.trigger:
+			if !p.paused.Load() {
+				p.send()
+			}
+		}
+	}
+}
+
+func (p *Periodic) next() time.Duration {
+	d := p.cfg.Period
+	if p.cfg.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.cfg.Jitter)))
+	}
+	return d
+}
+
+func (p *Periodic) run() {
+	var (
+		due     time.Time // next periodic send, zero without Period
+		last    time.Time
+		pending bool
+	)
+	if p.cfg.Period > 0 {
+		due = time.Now().Add(p.next())
+	}
+	t := time.NewTimer(time.Hour)
+	defer t.Stop()
+	for {
+		wake := due
+		if pending {
+			if earliest := last.Add(p.cfg.MinInterval); wake.IsZero() || earliest.Before(wake) {
+				wake = earliest
+			}
+		}
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		if !wake.IsZero() {
+			t.Reset(time.Until(wake))
+		}
+
+		select {
+		case <-p.e.quit:
+			return
+		case <-p.stop:
+			return
+		case <-p.trigger:
+			pending = true
+		case <-t.C:
+		}
+
+		now := time.Now()
+		if !due.IsZero() && !now.Before(due) {
+			pending = true
+			due = now.Add(p.next())
+		}
+		if !pending || now.Before(last.Add(p.cfg.MinInterval)) {
+			continue
+		}
+		pending = false
+		if p.paused.Load() {
+			continue
+		}
+		last = now
+		p.send()
+	}
+}
+
+func (p *Periodic) send() {
+	msg := p.payload.Load().(msgBox).msg
+	if p.cfg.Generate != nil {
+		msg = p.cfg.Generate()
+	}
+	if msg == nil {
+		return
+	}
+	timeout := p.cfg.Period
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.e.SendPriority(ctx, p.cfg.Priority, msg); err != nil && !errors.Is(err, ErrClosed) {
+		p.e.OnError(fmt.Errorf("periodic %X: %w", msg.Bytes(), err))
+	}
+}
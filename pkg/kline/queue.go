@@ -0,0 +1,99 @@
+package kline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// Priority is the outgoing queue a frame is sent through, frames in a higher class always go out first
+type Priority int
+
+const (
+	// PriorityPeriodic is for keep-alive and other frames that are sent again shortly anyway
+	PriorityPeriodic Priority = iota
+	// PriorityCommand is for requests such as the id 2 transponder commands
+	PriorityCommand
+	// PriorityControl is for frames that must not wait, such as the id 14 lock and release
+	PriorityControl
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityPeriodic:
+		return "periodic"
+	case PriorityCommand:
+		return "command"
+	case PriorityControl:
+		return "control"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultQueueLimits is how many frames each priority class queues before Send blocks, indexed by Priority
+var DefaultQueueLimits = [numPriorities]int{
+	PriorityPeriodic: 4,
+	PriorityCommand:  10,
+	PriorityControl:  10,
+}
+
+// Send queues msg as PriorityCommand, see SendPriority
+func (e *Engine) Send(ctx context.Context, msg message.Message) error {
+	return e.SendPriority(ctx, PriorityCommand, msg)
+}
+
+// SendPriority queues msg in the class prio, it blocks while that queue is full until ctx is done or the engine is closed
+func (e *Engine) SendPriority(ctx context.Context, prio Priority, msg message.Message) error {
+	if e.isClosed() {
+		return ErrClosed
+	}
+	if prio < 0 || prio >= numPriorities {
+		return fmt.Errorf("send: invalid priority %d", prio)
+	}
+	if msg == nil {
+		return errors.New("send: nil message")
+	}
+	select {
+	case e.outgoing[prio] <- msg:
+	case <-e.quit:
+		return ErrClosed
+	case <-ctx.Done():
+		return fmt.Errorf("send %s: %w", prio, ctx.Err())
+	}
+	return nil
+}
+
+// QueueDepth returns the number of frames waiting in each priority class, indexed by Priority
+func (e *Engine) QueueDepth() [numPriorities]int {
+	var depth [numPriorities]int
+	for i, q := range e.outgoing {
+		depth[i] = len(q)
+	}
+	return depth
+}
+
+// nextOutgoing returns the next frame to write, highest priority first, or false once the engine is closed
+func (e *Engine) nextOutgoing() (message.Message, bool) {
+	for p := numPriorities - 1; p >= 0; p-- {
+		select {
+		case msg := <-e.outgoing[p]:
+			return msg, true
+		default:
+		}
+	}
+	select {
+	case msg := <-e.outgoing[PriorityControl]:
+		return msg, true
+	case msg := <-e.outgoing[PriorityCommand]:
+		return msg, true
+	case msg := <-e.outgoing[PriorityPeriodic]:
+		return msg, true
+	case <-e.quit:
+		return nil, false
+	}
+}
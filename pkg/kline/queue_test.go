@@ -0,0 +1,134 @@
+package kline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// stalledPipe is a pipe end whose writes wait until release is closed, the frames queue up in the engine meanwhile
+type stalledPipe struct {
+	Transport
+	writing chan struct{} // a write is waiting
+	release chan struct{}
+}
+
+func newStalledPipe(t Transport) *stalledPipe {
+	return &stalledPipe{Transport: t, writing: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *stalledPipe) WriteFrame(frame []byte) error {
+	select {
+	case s.writing <- struct{}{}:
+	default:
+	}
+	select {
+	case <-s.release:
+	case <-time.After(5 * time.Second):
+		return errors.New("write not released")
+	}
+	return s.Transport.WriteFrame(frame)
+}
+
+// stall has the writer take a frame and wait on it, so every frame sent after stall returns stays queued
+func (s *stalledPipe) stall(t *testing.T, e *Engine) {
+	t.Helper()
+	if err := e.Send(context.Background(), message.New(2, []byte{0x00})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.writing:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not start a write")
+	}
+}
+
+func TestQueuePriorityOrder(t *testing.T) {
+	a, b := NewPipe()
+	defer b.Close()
+	sp := newStalledPipe(a)
+	e, err := NewWithTransport(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	sp.stall(t, e)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	queued := []struct {
+		prio Priority
+		msg  message.Message
+	}{
+		{PriorityPeriodic, message.New(2, []byte{0x10})},
+		{PriorityCommand, message.New(2, []byte{0x20})},
+		{PriorityPeriodic, message.New(2, []byte{0x11})},
+		{PriorityCommand, message.New(2, []byte{0x21})},
+		{PriorityControl, message.New(14, []byte{0x30})},
+		{PriorityControl, message.New(14, []byte{0x31})},
+	}
+	for _, q := range queued {
+		if err := e.SendPriority(ctx, q.prio, q.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth := e.QueueDepth(); depth != [numPriorities]int{2, 2, 2} {
+		t.Errorf("queue depth %v, want [2 2 2]", depth)
+	}
+	close(sp.release)
+
+	// the stalled frame first, then control, command and periodic, each class in the order it was queued
+	want := []byte{0x00, 0x30, 0x31, 0x20, 0x21, 0x10, 0x11}
+	for i, w := range want {
+		frame, err := b.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := message.NewFromBytes(frame.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Data()[0]; got != w {
+			t.Fatalf("frame %d is %02X, want %02X", i, got, w)
+		}
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	a, b := NewPipe()
+	defer b.Close()
+	sp := newStalledPipe(a)
+	e, err := NewWithTransport(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(sp.release)
+		e.Close()
+	}()
+	sp.stall(t, e)
+
+	for prio := PriorityPeriodic; prio < numPriorities; prio++ {
+		for i := 0; i < DefaultQueueLimits[prio]; i++ {
+			if err := e.SendPriority(context.Background(), prio, message.New(2, []byte{byte(i)})); err != nil {
+				t.Fatalf("%s frame %d: %v", prio, i, err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := e.SendPriority(ctx, prio, message.New(2, []byte{0xff}))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s send over the limit: %v, want %v", prio, err, context.DeadlineExceeded)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("%s send over the limit returned after %s, want it to block until the deadline", prio, d)
+		}
+	}
+	if depth := e.QueueDepth(); depth != DefaultQueueLimits {
+		t.Errorf("queue depth %v, want %v", depth, DefaultQueueLimits)
+	}
+}
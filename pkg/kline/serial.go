@@ -0,0 +1,54 @@
+package kline
+
+import (
+	"fmt"
+
+	"go.bug.st/serial"
+)
+
+// serialPort talks raw K-line through a serial port
+type serialPort struct {
+	*stream
+}
+
+// NewSerialTransport returns a transport for a K-line cable on the named serial port, using 9600 8O1
+func NewSerialTransport(portName string, cfg StreamConfig) Transport {
+	return &serialPort{
+		stream: newStream(portName, nil, cfg),
+	}
+}
+
+func (s *serialPort) Open() error {
+	mode := &serial.Mode{
+		BaudRate: 9600,
+		DataBits: 8,
+		Parity:   serial.OddParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	sr, err := serial.Open(s.name, mode)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", s.name, err)
+	}
+
+	if err := sr.ResetInputBuffer(); err != nil {
+		sr.Close()
+		return err
+	}
+	if err := sr.ResetOutputBuffer(); err != nil {
+		sr.Close()
+		return err
+	}
+
+	if err := sr.SetReadTimeout(s.cfg.ReadTimeout); err != nil {
+		sr.Close()
+		return err
+	}
+
+	s.attach(sr)
+	return s.stream.Open()
+}
+
+func (s *serialPort) Capabilities() Capabilities {
+	return Capabilities{Name: "serial " + s.name, Checksum: s.cfg.Checksum, Echo: s.cfg.Echo, EchoWindow: s.cfg.EchoWindow}
+}
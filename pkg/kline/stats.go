@@ -0,0 +1,217 @@
+package kline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram buckets, a last bucket catches everything slower
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Stats is a snapshot of the engine counters since it was created
+type Stats struct {
+	Transport string
+
+	FramesIn  [16]uint64 // per message id
+	FramesOut [16]uint64 // per message id
+	BytesIn   uint64     // frame bytes without checksum
+	BytesOut  uint64
+
+	ReadErrors      uint64
+	WriteErrors     uint64 // frames that could not be written, including while the link was down
+	Collisions      uint64 // transmitted frames without echo
+	SubscriberDrops uint64 // messages lost on full subscriber channels
+
+	// Decoder holds the byte stream counters of transports that decode frames themselves
+	Decoder *DecoderStats
+
+	QueueDepth [numPriorities]int
+
+	// Latency is the time from writing a request to its first response,
+	// keyed by request id and first data byte such as "2:03" for the radio open command
+	Latency map[string]Histogram
+}
+
+// Histogram counts durations in LatencyBuckets
+type Histogram struct {
+	Buckets []time.Duration // upper bounds, Counts has one more entry for slower values
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+	Min     time.Duration
+	Max     time.Duration
+}
+
+func newHistogram() Histogram {
+	return Histogram{
+		Buckets: LatencyBuckets,
+		Counts:  make([]uint64, len(LatencyBuckets)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Buckets) && d > h.Buckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Sum += d
+}
+
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+func (h Histogram) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "n=%d min=%s mean=%s max=%s", h.Count, h.Min, h.Mean(), h.Max)
+	for i, c := range h.Counts {
+		if c == 0 {
+			continue
+		}
+		if i < len(h.Buckets) {
+			fmt.Fprintf(&sb, " <=%s:%d", h.Buckets[i], c)
+		} else {
+			fmt.Fprintf(&sb, " >%s:%d", h.Buckets[len(h.Buckets)-1], c)
+		}
+	}
+	return sb.String()
+}
+
+// engineStats holds the live counters behind Engine.Stats
+type engineStats struct {
+	framesIn, framesOut [16]atomic.Uint64
+	bytesIn, bytesOut   atomic.Uint64
+
+	readErrors, writeErrors, collisions, subscriberDrops atomic.Uint64
+
+	mu      sync.Mutex
+	latency map[string]*Histogram
+}
+
+func (s *engineStats) in(m message.Message) {
+	s.framesIn[m.ID()&0x0f].Add(1)
+	s.bytesIn.Add(uint64(len(m.Data()) + 1))
+}
+
+func (s *engineStats) out(m message.Message) {
+	s.framesOut[m.ID()&0x0f].Add(1)
+	s.bytesOut.Add(uint64(len(m.Data()) + 1))
+}
+
+// latencyKey names the request kind a latency is recorded for
+func latencyKey(req message.Message) string {
+	if data := req.Data(); len(data) > 0 {
+		return fmt.Sprintf("%d:%02X", req.ID(), data[0])
+	}
+	return fmt.Sprintf("%d", req.ID())
+}
+
+func (s *engineStats) observeLatency(key string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latency == nil {
+		s.latency = make(map[string]*Histogram)
+	}
+	h, ok := s.latency[key]
+	if !ok {
+		hist := newHistogram()
+		h = &hist
+		s.latency[key] = h
+	}
+	h.observe(d)
+}
+
+// Stats returns a snapshot of the engine counters
+func (e *Engine) Stats() Stats {
+	st := Stats{
+		Transport:       e.t.Capabilities().Name,
+		BytesIn:         e.stats.bytesIn.Load(),
+		BytesOut:        e.stats.bytesOut.Load(),
+		ReadErrors:      e.stats.readErrors.Load(),
+		WriteErrors:     e.stats.writeErrors.Load(),
+		Collisions:      e.stats.collisions.Load(),
+		SubscriberDrops: e.stats.subscriberDrops.Load(),
+		QueueDepth:      e.QueueDepth(),
+		Latency:         make(map[string]Histogram),
+	}
+	for i := range st.FramesIn {
+		st.FramesIn[i] = e.stats.framesIn[i].Load()
+		st.FramesOut[i] = e.stats.framesOut[i].Load()
+	}
+	if ds, ok := e.t.(interface{ DecoderStats() DecoderStats }); ok {
+		d := ds.DecoderStats()
+		st.Decoder = &d
+	}
+	e.stats.mu.Lock()
+	for id, h := range e.stats.latency {
+		c := *h
+		c.Counts = append([]uint64(nil), h.Counts...)
+		st.Latency[id] = c
+	}
+	e.stats.mu.Unlock()
+	return st
+}
+
+// trackedMsg is a queued request whose write time is wanted for the latency histogram,
+// the writer sends the time on written and closes it, without a time if the write failed
+type trackedMsg struct {
+	message.Message
+	written chan time.Time
+}
+
+// sendTracked queues msg and returns a channel receiving the time it was written
+func (e *Engine) sendTracked(ctx context.Context, msg message.Message) (<-chan time.Time, error) {
+	if msg == nil {
+		return nil, errors.New("send: nil message")
+	}
+	t := &trackedMsg{Message: msg, written: make(chan time.Time, 1)}
+	if err := e.SendPriority(ctx, PriorityCommand, t); err != nil {
+		return nil, err
+	}
+	return t.written, nil
+}
+
+// observeResponse records the latency of resp to req, written reports when req went out.
+// A frame received before the write is not the response to it and is not recorded.
+func (e *Engine) observeResponse(ctx context.Context, req, resp message.Message, written <-chan time.Time) {
+	received := time.Now()
+	if rx, ok := resp.(*RxMsg); ok && !rx.Received.IsZero() {
+		received = rx.Received
+	}
+	// the response can be handled before the writer has reported the write
+	select {
+	case at, ok := <-written:
+		if ok && received.After(at) {
+			e.stats.observeLatency(latencyKey(req), received.Sub(at))
+		}
+	case <-ctx.Done():
+	case <-e.quit:
+	}
+}
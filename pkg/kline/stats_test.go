@@ -0,0 +1,51 @@
+package kline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+func TestObserveResponse(t *testing.T) {
+	a, _ := NewPipe()
+	e, err := NewWithTransport(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	req := message.New(2, []byte{0x03, 0x1f})
+	at := time.Now()
+	response := func(received time.Time) message.Message {
+		return &RxMsg{Message: message.New(2, []byte{0x03, 0x15}), Received: received}
+	}
+	observe := func(received time.Time) {
+		written := make(chan time.Time, 1)
+		written <- at
+		e.observeResponse(context.Background(), req, response(received), written)
+	}
+
+	// a frame that came in before the request went out is not its response
+	observe(at.Add(-time.Millisecond))
+	if h, ok := e.Stats().Latency["2:03"]; ok {
+		t.Errorf("latency recorded for a frame received before the write: %s", h)
+	}
+	observe(at.Add(30 * time.Millisecond))
+	if h := e.Stats().Latency["2:03"]; h.Count != 1 || h.Min != 30*time.Millisecond {
+		t.Errorf("latency %s, want one of 30ms", h)
+	}
+
+	// the write is never reported, closing the engine ends the wait even without a ctx deadline
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.observeResponse(context.Background(), req, response(time.Now()), make(chan time.Time))
+	}()
+	e.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiting for the write outlives the engine")
+	}
+}
@@ -0,0 +1,143 @@
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// StreamConfig holds the framing options of transports carrying the raw K-line byte stream
+type StreamConfig struct {
+	Checksum message.Checksum
+	// InterByteTimeout is the gap after which a partial frame is thrown away
+	InterByteTimeout time.Duration
+	// ReadTimeout is how long ReadFrame waits for bytes before returning an empty frame
+	ReadTimeout time.Duration
+	// Echo is true if the line reads back transmitted frames, as single-wire K-line cables do
+	Echo bool
+	// EchoWindow is how long after a write its echo may take to come back, zero for the transport default
+	EchoWindow time.Duration
+}
+
+// DefaultStreamConfig matches the old serial code, checksum on both directions and timeouts generous enough for USB serial latency
+var DefaultStreamConfig = StreamConfig{
+	Checksum:         message.ChecksumAppend | message.ChecksumVerify,
+	InterByteTimeout: 20 * time.Millisecond,
+	ReadTimeout:      40 * time.Millisecond,
+	Echo:             true,
+}
+
+// stream frames raw K-line bytes read from and written to rw, frames on the wire carry a trailing additive checksum
+type stream struct {
+	name string
+	rw   io.ReadWriteCloser
+	cfg  StreamConfig
+
+	dec *Decoder
+	buf []byte
+
+	mu     sync.Mutex // guards closed, Close can run while a read is blocked
+	closed bool
+}
+
+// NewStreamTransport returns a transport that frames the raw K-line byte stream on rw, such as a pseudo-terminal
+func NewStreamTransport(name string, rw io.ReadWriteCloser, cfg StreamConfig) Transport {
+	return newStream(name, rw, cfg)
+}
+
+func newStream(name string, rw io.ReadWriteCloser, cfg StreamConfig) *stream {
+	return &stream{
+		name: name,
+		rw:   rw,
+		cfg:  cfg,
+		dec:  NewDecoder(cfg.InterByteTimeout, cfg.Checksum),
+		buf:  make([]byte, 64),
+	}
+}
+
+// Open fails once rw was closed, transports that reopen their device attach the new one first
+func (s *stream) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrTransportClosed
+	}
+	s.dec.Reset()
+	return nil
+}
+
+// attach replaces rw with a freshly opened device
+func (s *stream) attach(rw io.ReadWriteCloser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rw = rw
+	s.closed = false
+}
+
+// Close closes rw once, closing again is not an error as the engine and its reconnect can both close the transport
+func (s *stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rw == nil || s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.rw.Close()
+}
+
+func (s *stream) Capabilities() Capabilities {
+	return Capabilities{Name: s.name, Checksum: s.cfg.Checksum, Echo: s.cfg.Echo, EchoWindow: s.cfg.EchoWindow}
+}
+
+// DecoderStats returns the frame decoder counters, BadFrames tells how noisy the line is
+func (s *stream) DecoderStats() DecoderStats {
+	return s.dec.Stats()
+}
+
+// ReadFrame returns the next frame with the checksum stripped, or an empty frame if no complete frame has arrived yet.
+// Like Decoder.Next both frame and error are returned for a checksum mismatch in ChecksumLogOnly mode
+func (s *stream) ReadFrame() (Frame, error) {
+	data, err := s.read()
+	return Frame{Data: data}, err
+}
+
+func (s *stream) read() ([]byte, error) {
+	if frame, err := s.dec.Next(); frame != nil || err != nil {
+		return frame, err
+	}
+	if d, ok := s.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := d.SetReadDeadline(time.Now().Add(s.cfg.ReadTimeout)); err != nil {
+			return nil, fmt.Errorf("%s set read deadline: %w", s.name, err)
+		}
+	}
+	n, err := s.rw.Read(s.buf)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil
+		}
+		if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+			return nil, ErrTransportClosed
+		}
+		return nil, linkDown(fmt.Errorf("%s read: %w", s.name, err))
+	}
+	s.dec.Feed(time.Now(), s.buf[:n])
+	return s.dec.Next()
+}
+
+func (s *stream) WriteFrame(frame []byte) error {
+	out := s.cfg.Checksum.Encode(frame)
+	n, err := s.rw.Write(out)
+	if err != nil {
+		return linkDown(fmt.Errorf("%s write: %w", s.name, err))
+	}
+	if n != len(out) {
+		return fmt.Errorf("%s write: wrote %d of %d bytes", s.name, n, len(out))
+	}
+	return nil
+}
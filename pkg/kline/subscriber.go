@@ -3,6 +3,8 @@ package kline
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,48 +14,323 @@ import (
 var (
 	ErrFailedToUnregister = errors.New("failed to unregister subscriber")
 	ErrFailedToSubscribe  = errors.New("failed to subscribe")
+	ErrSubscriberClosed   = errors.New("subscriber closed")
+	ErrSubscriberEvicted  = errors.New("subscriber evicted")
 )
 
+// OverflowPolicy is what the engine does with a message for a subscriber whose channel is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the message that does not fit
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest queued message to make room
+	OverflowDropOldest
+	// OverflowBlock waits up to BlockTimeout for room and evicts the subscriber if none frees up,
+	// every other subscriber waits meanwhile
+	OverflowBlock
+	// OverflowUnbounded queues every message, a subscriber that stops reading grows without limit
+	OverflowUnbounded
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop newest"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowBlock:
+		return "block"
+	case OverflowUnbounded:
+		return "unbounded"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscribeOptions controls how messages are queued for a subscriber
+type SubscribeOptions struct {
+	Overflow OverflowPolicy
+	// Buffer is the size of the message channel
+	Buffer int
+	// BlockTimeout is how long OverflowBlock waits for room
+	BlockTimeout time.Duration
+	// EvictAfter removes the subscriber after this many messages dropped in a row, zero never evicts
+	EvictAfter int
+}
+
+var DefaultSubscribeOptions = SubscribeOptions{
+	Overflow:     OverflowDropNewest,
+	Buffer:       10,
+	BlockTimeout: 100 * time.Millisecond,
+}
+
+// Subscribe registers a subscriber for messages with one of identifiers, or every message if none are given.
+// The subscriber is removed and its channel closed as soon as ctx is done or Close is called.
 func (e *Engine) Subscribe(ctx context.Context, identifiers ...uint8) (*Subscriber, error) {
-	cb := make(chan message.Message, 10)
-	sub := &Subscriber{
+	sub := e.newSubscriber(ctx, DefaultSubscribeOptions)
+	sub.identifiers.Store(identifiers)
+	return e.subscribe(ctx, sub)
+}
+
+// SubscribeFunc registers a subscriber for the messages match accepts, the ID filter is not used
+func (e *Engine) SubscribeFunc(ctx context.Context, match Matcher) (*Subscriber, error) {
+	return e.SubscribeWith(ctx, DefaultSubscribeOptions, match)
+}
+
+// SubscribeWith is SubscribeFunc with the overflow handling given by opts, a nil match accepts every message
+func (e *Engine) SubscribeWith(ctx context.Context, opts SubscribeOptions, match Matcher) (*Subscriber, error) {
+	sub := e.newSubscriber(ctx, opts)
+	sub.match = match
+	return e.subscribe(ctx, sub)
+}
+
+func (e *Engine) newSubscriber(ctx context.Context, opts SubscribeOptions) *Subscriber {
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultSubscribeOptions.Buffer
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = DefaultSubscribeOptions.BlockTimeout
+	}
+	s := &Subscriber{
 		e:        e,
 		ctx:      ctx,
-		callback: cb,
+		opts:     opts,
+		callback: make(chan message.Message, opts.Buffer),
+		closed:   make(chan struct{}),
+		removed:  make(chan struct{}),
 	}
-	sub.identifiers.Store(identifiers)
+	if opts.Overflow == OverflowUnbounded {
+		s.queue = newUnboundedQueue()
+		go s.queue.pump(s.callback)
+	}
+	return s
+}
 
+// subscribe returns once the handler has added sub to its listeners
+func (e *Engine) subscribe(ctx context.Context, sub *Subscriber) (*Subscriber, error) {
+	if e.isClosed() {
+		sub.discard()
+		return nil, ErrClosed
+	}
+	// the adapter has to pass the frames before the caller can send a request they answer
+	e.filterAdd(sub)
 	select {
 	case e.register <- sub:
-	case <-time.After(1 * time.Second):
-		return nil, ErrFailedToSubscribe
+	case <-ctx.Done():
+		sub.discard()
+		return nil, fmt.Errorf("%w: %v", ErrFailedToSubscribe, ctx.Err())
+	case <-e.quit:
+		sub.discard()
+		return nil, ErrClosed
 	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.closed:
+		case <-sub.removed:
+		}
+	}()
+
 	return sub, nil
 }
 
 type Subscriber struct {
 	e           *Engine
 	ctx         context.Context
-	errcount    uint8
+	opts        SubscribeOptions
 	identifiers atomic.Value
+	match       Matcher
 	callback    chan message.Message
+	queue       *unboundedQueue // feeds callback for OverflowUnbounded
+
+	dropped     atomic.Uint64
+	dropsInARow int   // only touched by the handler
+	err         error // why the subscriber was removed, set by the handler before callback is closed
+
+	fmask   uint16 // ids counted in the engine filter, guarded by e.filter.mu
+	counted bool
+
+	closeOnce sync.Once
+	closed    chan struct{} // Close was called
+	removed   chan struct{} // the handler has removed the subscriber
 }
 
+// Close unregisters the subscriber, it is safe to call more than once and after the engine is closed
 func (s *Subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		defer close(s.closed)
+		select {
+		case s.e.unregister <- s:
+		case <-s.removed:
+			// evicted, or the engine was closed
+		}
+	})
+	return nil
+}
+
+// Chan returns the message channel, it is closed once the subscriber has been removed
+func (s *Subscriber) Chan() chan message.Message {
+	return s.callback
+}
+
+// Dropped returns the number of messages lost because the channel was full
+func (s *Subscriber) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Err returns ErrSubscriberEvicted once the engine has removed the subscriber for not keeping up,
+// it is only valid after Chan has been closed
+func (s *Subscriber) Err() error {
+	return s.err
+}
+
+// accepts reports if msg is for this subscriber
+func (s *Subscriber) accepts(msg message.Message) bool {
+	if s.match != nil {
+		return s.match.Match(msg)
+	}
+	ids := s.GetIDFilter()
+	if len(ids) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		if id == msg.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver queues msg according to the overflow policy and returns false if the subscriber has to be evicted,
+// it is only called from the handler
+func (s *Subscriber) deliver(msg message.Message) bool {
+	if s.queue != nil {
+		s.queue.push(msg)
+		return true
+	}
 	select {
-	case s.e.unregister <- s:
-		return nil
+	case s.callback <- msg:
+		s.dropsInARow = 0
+		return true
 	default:
-		return ErrFailedToUnregister
 	}
+	switch s.opts.Overflow {
+	case OverflowDropOldest:
+		select {
+		case <-s.callback:
+			s.drop()
+		default:
+		}
+		select {
+		case s.callback <- msg:
+			return s.opts.EvictAfter == 0 || s.dropsInARow < s.opts.EvictAfter
+		default:
+		}
+	case OverflowBlock:
+		t := time.NewTimer(s.opts.BlockTimeout)
+		defer t.Stop()
+		select {
+		case s.callback <- msg:
+			s.dropsInARow = 0
+			return true
+		case <-t.C:
+			s.drop()
+			return false
+		}
+	}
+	s.drop()
+	return s.opts.EvictAfter == 0 || s.dropsInARow < s.opts.EvictAfter
 }
 
-func (s *Subscriber) Chan() chan message.Message {
-	return s.callback
+func (s *Subscriber) drop() {
+	s.e.stats.subscriberDrops.Add(1)
+	s.dropped.Add(1)
+	s.dropsInARow++
+}
+
+// close closes the message channel, called by the handler once the subscriber is out of listeners
+func (s *Subscriber) close(reason error) {
+	s.e.filterRemove(s)
+	s.err = reason
+	close(s.removed)
+	if s.queue != nil {
+		s.queue.close()
+		return
+	}
+	close(s.callback)
+}
+
+// discard releases a subscriber that never got registered
+func (s *Subscriber) discard() {
+	s.e.filterRemove(s)
+	if s.queue != nil {
+		s.queue.close()
+	}
+}
+
+// unboundedQueue buffers messages for an OverflowUnbounded subscriber so the handler never waits on it
+type unboundedQueue struct {
+	mu   sync.Mutex
+	msgs []message.Message
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newUnboundedQueue() *unboundedQueue {
+	return &unboundedQueue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+func (q *unboundedQueue) push(msg message.Message) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *unboundedQueue) close() {
+	close(q.done)
+}
+
+// pump moves queued messages to out and closes out once the queue is closed
+func (q *unboundedQueue) pump(out chan message.Message) {
+	defer close(out)
+	for {
+		q.mu.Lock()
+		var msg message.Message
+		if len(q.msgs) > 0 {
+			msg = q.msgs[0]
+			q.msgs[0] = nil
+			q.msgs = q.msgs[1:]
+		}
+		q.mu.Unlock()
+		if msg == nil {
+			select {
+			case <-q.wake:
+			case <-q.done:
+				return
+			}
+			continue
+		}
+		select {
+		case out <- msg:
+		case <-q.done:
+			return
+		}
+	}
 }
 
 func (s *Subscriber) SetIDFilter(identifiers ...uint8) {
 	s.identifiers.Store(identifiers)
+	s.e.filterUpdate(s)
 }
 
 func (s *Subscriber) GetIDFilter() []uint8 {
@@ -0,0 +1,155 @@
+package kline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+func TestSubscriberOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    SubscribeOptions
+		send    int
+		delay   time.Duration // the subscriber reads while the messages are sent, waiting delay after each
+		want    []byte        // data of the messages the subscriber reads
+		dropped uint64
+		evicted bool
+	}{
+		{"drop newest", SubscribeOptions{Overflow: OverflowDropNewest, Buffer: 2}, 5, 0, []byte{0, 1}, 3, false},
+		{"drop oldest", SubscribeOptions{Overflow: OverflowDropOldest, Buffer: 2}, 5, 0, []byte{3, 4}, 3, false},
+		{"block times out", SubscribeOptions{Overflow: OverflowBlock, Buffer: 1, BlockTimeout: 20 * time.Millisecond}, 3, 0, []byte{0}, 1, true},
+		{"block waits for room", SubscribeOptions{Overflow: OverflowBlock, Buffer: 1, BlockTimeout: time.Second}, 4, 5 * time.Millisecond, []byte{0, 1, 2, 3}, 0, false},
+		{"unbounded", SubscribeOptions{Overflow: OverflowUnbounded, Buffer: 1}, 40, 0, sequence(40), 0, false},
+		{"drop newest evict after", SubscribeOptions{Overflow: OverflowDropNewest, Buffer: 2, EvictAfter: 2}, 5, 0, []byte{0, 1}, 2, true},
+		{"drop oldest evict after", SubscribeOptions{Overflow: OverflowDropOldest, Buffer: 2, EvictAfter: 3}, 6, 0, []byte{3, 4}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := NewPipe()
+			defer b.Close()
+			e, err := NewWithTransport(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			evicts := make(chan error, 1)
+			e.OnEvict = func(sub *Subscriber, err error) { evicts <- err }
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			sub, err := e.SubscribeWith(ctx, tt.opts, MatchID(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			// id 3 marks the end, once it is read every message before it went through fanout
+			marker, err := e.Subscribe(ctx, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer marker.Close()
+
+			var got []byte
+			done := make(chan struct{})
+			read := func() {
+				defer close(done)
+				for len(got) < len(tt.want) {
+					select {
+					case msg, ok := <-sub.Chan():
+						if !ok {
+							return
+						}
+						got = append(got, msg.Data()[0])
+						time.Sleep(tt.delay)
+					case <-time.After(time.Second):
+						return
+					}
+				}
+			}
+			if tt.delay > 0 {
+				go read()
+			}
+			for i := 0; i < tt.send; i++ {
+				if err := b.WriteFrame(message.New(1, []byte{byte(i)}).Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.WriteFrame(message.New(3, []byte{0xff}).Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-marker.Chan():
+			case <-ctx.Done():
+				t.Fatal("marker message not received")
+			}
+			if tt.delay == 0 {
+				go read()
+			}
+			<-done
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("read % X, want % X", got, tt.want)
+			}
+			if n := sub.Dropped(); n != tt.dropped {
+				t.Errorf("Dropped() = %d, want %d", n, tt.dropped)
+			}
+			if n := e.Stats().SubscriberDrops; n != tt.dropped {
+				t.Errorf("engine subscriber drops %d, want %d", n, tt.dropped)
+			}
+
+			if tt.evicted {
+				select {
+				case err := <-evicts:
+					if !errors.Is(err, ErrSubscriberEvicted) {
+						t.Errorf("OnEvict with %v, want %v", err, ErrSubscriberEvicted)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("OnEvict not called")
+				}
+				select {
+				case msg, ok := <-sub.Chan():
+					if ok {
+						t.Fatalf("message % X after eviction", msg.Bytes())
+					}
+				case <-time.After(time.Second):
+					t.Fatal("channel not closed after eviction")
+				}
+				if err := sub.Err(); !errors.Is(err, ErrSubscriberEvicted) {
+					t.Errorf("Err() = %v, want %v", err, ErrSubscriberEvicted)
+				}
+				return
+			}
+
+			sub.Close()
+			select {
+			case msg, ok := <-sub.Chan():
+				if ok {
+					t.Fatalf("unexpected message % X", msg.Bytes())
+				}
+			case <-time.After(time.Second):
+				t.Fatal("channel not closed after Close")
+			}
+			if err := sub.Err(); err != nil {
+				t.Errorf("Err() = %v after Close", err)
+			}
+			select {
+			case err := <-evicts:
+				t.Errorf("OnEvict called with %v", err)
+			default:
+			}
+		})
+	}
+}
+
+func sequence(n int) []byte {
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = byte(i)
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+package kline
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPScheme prefixes port names that select a raw TCP K-line endpoint, such as tcp://garage:4001 served by ser2net
+const TCPScheme = "tcp://"
+
+const tcpDialTimeout = 5 * time.Second
+
+// DefaultTCPStreamConfig is DefaultStreamConfig for a byte stream carried over the network, a frame split across TCP
+// segments can arrive with gaps far longer than on a local port, over Wi-Fi or behind ser2net's chardelay
+var DefaultTCPStreamConfig = StreamConfig{
+	Checksum:         DefaultStreamConfig.Checksum,
+	InterByteTimeout: 250 * time.Millisecond,
+	ReadTimeout:      DefaultStreamConfig.ReadTimeout,
+	Echo:             DefaultStreamConfig.Echo,
+}
+
+// tcpTransport carries the raw K-line byte stream over TCP, framing is the same as a local serial port
+type tcpTransport struct {
+	*stream
+	addr string
+}
+
+// NewTCPTransport returns a transport for a raw K-line byte stream served at addr, cfg is usually
+// DefaultTCPStreamConfig. The echo window defaults to DefaultTCPEchoWindow as the echo makes a round trip over the network.
+func NewTCPTransport(addr string, cfg StreamConfig) Transport {
+	if cfg.EchoWindow == 0 {
+		cfg.EchoWindow = DefaultTCPEchoWindow
+	}
+	return &tcpTransport{
+		stream: newStream(TCPScheme+addr, nil, cfg),
+		addr:   addr,
+	}
+}
+
+func (t *tcpTransport) Open() error {
+	conn, err := net.DialTimeout("tcp", t.addr, tcpDialTimeout)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", t.addr, err)
+	}
+	t.attach(conn)
+	return t.stream.Open()
+}
@@ -0,0 +1,241 @@
+package kline_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/ismsim"
+	"github.com/roffe/ismtool/pkg/kline"
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// listen serves every connection on a loopback listener with serve until the test ends
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// delayedEcho writes every byte read back after delay, like a single-wire line behind a slow link
+func delayedEcho(delay time.Duration) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(delay)
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// txRecorder keeps the transmissions and errors reported by an engine
+type txRecorder struct {
+	mu   sync.Mutex
+	tx   []*kline.TxMsg
+	errs []error
+}
+
+func (r *txRecorder) onOutgoing(msg message.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tx = append(r.tx, msg.(*kline.TxMsg))
+}
+
+func (r *txRecorder) onError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+// result waits up to a second for n transmissions, OnOutgoing is called from its own goroutine
+func (r *txRecorder) result(n int) ([]*kline.TxMsg, []error) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		if len(r.tx) >= n || time.Now().After(deadline) {
+			defer r.mu.Unlock()
+			return append([]*kline.TxMsg(nil), r.tx...), append([]error(nil), r.errs...)
+		}
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func dialEngine(t *testing.T, addr string, cfg kline.StreamConfig, r *txRecorder) *kline.Engine {
+	t.Helper()
+	e, err := kline.NewWithOptions(kline.NewTCPTransport(addr, cfg), kline.Options{OnError: r.onError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.OnOutgoing = r.onOutgoing
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestTCPSimulator(t *testing.T) {
+	sim := ismsim.New()
+	sim.Echo = true
+	quit := make(chan struct{})
+	addr := listen(t, func(conn net.Conn) {
+		sim.Serve(kline.NewStreamTransport(conn.RemoteAddr().String(), conn, kline.DefaultTCPStreamConfig), quit)
+	})
+	t.Cleanup(func() { close(quit) })
+
+	var r txRecorder
+	e := dialEngine(t, addr, kline.DefaultTCPStreamConfig, &r)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := e.SendAndRecv(ctx, message.New(2, []byte{0x03, 0x1f}), kline.MatchCommand(2, 0x03))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Data(), []byte{0x03, 0x15}) {
+		t.Errorf("open answered %X", resp.Data())
+	}
+	tx, errs := r.result(1)
+	if len(tx) != 1 || tx[0].Status != kline.TxConfirmed {
+		t.Errorf("transmissions %v, want one confirmed", tx)
+	}
+	if len(errs) != 0 {
+		t.Errorf("errors %v", errs)
+	}
+}
+
+func TestTCPEchoWindow(t *testing.T) {
+	addr := listen(t, delayedEcho(150*time.Millisecond))
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		status kline.TxStatus
+	}{
+		{"default window", 0, kline.TxConfirmed},
+		{"window too short", 50 * time.Millisecond, kline.TxUnconfirmed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := kline.DefaultStreamConfig
+			cfg.EchoWindow = tt.window
+			var r txRecorder
+			e := dialEngine(t, addr, cfg, &r)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			// a late echo delivered as received frame would pass as the answer to the request
+			_, err := e.SendAndRecv(ctx, message.New(2, []byte{0x03, 0x1f}), kline.MatchCommand(2, 0x03))
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("got %v, want no answer", err)
+			}
+
+			tx, errs := r.result(1)
+			if len(tx) != 1 || tx[0].Status != tt.status {
+				t.Fatalf("transmissions %v, want one %s", tx, tt.status)
+			}
+			if tt.status == kline.TxConfirmed {
+				if len(errs) != 0 {
+					t.Errorf("errors %v", errs)
+				}
+				return
+			}
+			var late bool
+			for _, err := range errs {
+				late = late || errors.Is(err, kline.ErrLateEcho)
+			}
+			if !late {
+				t.Errorf("errors %v, want %v", errs, kline.ErrLateEcho)
+			}
+		})
+	}
+}
+
+// splitReply echoes every request and answers it with 03 15 in two segments gap apart
+func splitReply(gap time.Duration) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		buf := make([]byte, 64)
+		reply := kline.DefaultTCPStreamConfig.Checksum.Encode(message.New(2, []byte{0x03, 0x15}).Bytes())
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+			if _, err := conn.Write(reply[:2]); err != nil {
+				return
+			}
+			time.Sleep(gap)
+			if _, err := conn.Write(reply[2:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestTCPSplitFrame(t *testing.T) {
+	addr := listen(t, splitReply(100*time.Millisecond))
+
+	tests := []struct {
+		name   string
+		cfg    kline.StreamConfig
+		answer bool
+	}{
+		{"tcp defaults", kline.DefaultTCPStreamConfig, true},
+		{"serial inter-byte timeout", kline.DefaultStreamConfig, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r txRecorder
+			e := dialEngine(t, addr, tt.cfg, &r)
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			resp, err := e.SendAndRecv(ctx, message.New(2, []byte{0x03, 0x1f}), kline.MatchCommand(2, 0x03))
+			if !tt.answer {
+				if err == nil {
+					t.Fatalf("frame with a %s gap decoded: %X", 100*time.Millisecond, resp.Data())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(resp.Data(), []byte{0x03, 0x15}) {
+				t.Errorf("answered %X", resp.Data())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package kline
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+var ErrTransportClosed = errors.New("transport closed")
+
+// Transport is the link the Engine reads and writes raw frames through.
+// Frames are passed without checksum, a transport that talks to a raw UART adds and strips it according to its message.Checksum mode.
+type Transport interface {
+	Open() error
+	// ReadFrame returns the next frame, a frame without data means nothing arrived within the transports read timeout
+	ReadFrame() (Frame, error)
+	WriteFrame(frame []byte) error
+	// Close may be called while ReadFrame, WriteFrame or Open run, a blocked read or write returns. Closing again is not an error.
+	Close() error
+	Capabilities() Capabilities
+}
+
+// PeriodicTransport is implemented by transports whose adapter can send periodic frames by itself,
+// the Engine hands fixed frames with a fixed period to it instead of running a timer
+type PeriodicTransport interface {
+	// StartPeriodic starts sending frame every period and returns the id to stop it with,
+	// ids are lost when the transport is closed
+	StartPeriodic(frame []byte, period time.Duration) (id uint32, err error)
+	StopPeriodic(id uint32) error
+}
+
+// VoltageTransport is implemented by transports whose adapter measures its supply voltage
+type VoltageTransport interface {
+	// ReadVoltage returns the supply voltage in volts
+	ReadVoltage() (float64, error)
+}
+
+// FilterTransport is implemented by transports whose adapter can drop frames by message id before they reach the host
+type FilterTransport interface {
+	// SetRxFilter passes only the frames whose id bit is set in ids, replacing the filters set before
+	SetRxFilter(ids uint16) error
+}
+
+// InfoTransport is implemented by transports that can identify their adapter
+type InfoTransport interface {
+	AdapterInfo() (AdapterInfo, error)
+}
+
+// Capabilities describes what the transport or adapter handles by itself
+type Capabilities struct {
+	Name string
+	// Checksum is how the transport itself handles frame checksums, ChecksumNone if the adapter takes care of it
+	Checksum message.Checksum
+	// Echo is true if transmitted frames are read back from the line
+	Echo bool
+	// EchoWindow is how long a transmitted frame may take to be read back, zero for DefaultEchoWindow
+	EchoWindow time.Duration
+}
+
+// NewTransport returns the transport for the given port name, J2534 selects the J2534 adapter,
+// tcp://host:port a remote K-line endpoint and anything else is treated as a serial port
+func NewTransport(portName string) Transport {
+	switch {
+	case portName == J2534:
+		return NewJ2534Transport(DefaultJ2534Config)
+	case strings.HasPrefix(portName, TCPScheme):
+		return NewTCPTransport(strings.TrimPrefix(portName, TCPScheme), DefaultTCPStreamConfig)
+	default:
+		return NewSerialTransport(portName, DefaultStreamConfig)
+	}
+}
+
+const pipeReadTimeout = 50 * time.Millisecond
+
+// NewPipe returns two connected in-memory transports, frames written to one end are read from the other
+func NewPipe() (Transport, Transport) {
+	ab := make(chan []byte, 32)
+	ba := make(chan []byte, 32)
+	quit := make(chan struct{})
+	var once sync.Once
+	closer := func() { once.Do(func() { close(quit) }) }
+	return &pipe{rx: ba, tx: ab, quit: quit, close: closer}, &pipe{rx: ab, tx: ba, quit: quit, close: closer}
+}
+
+type pipe struct {
+	rx    <-chan []byte
+	tx    chan<- []byte
+	quit  chan struct{}
+	close func()
+}
+
+func (p *pipe) Open() error {
+	select {
+	case <-p.quit:
+		return ErrTransportClosed
+	default:
+		return nil
+	}
+}
+
+func (p *pipe) ReadFrame() (Frame, error) {
+	t := time.NewTimer(pipeReadTimeout)
+	defer t.Stop()
+	select {
+	case frame := <-p.rx:
+		return Frame{Data: frame}, nil
+	case <-t.C:
+		return Frame{}, nil
+	case <-p.quit:
+		return Frame{}, ErrTransportClosed
+	}
+}
+
+func (p *pipe) WriteFrame(frame []byte) error {
+	out := make([]byte, len(frame))
+	copy(out, frame)
+	select {
+	case p.tx <- out:
+		return nil
+	case <-p.quit:
+		return ErrTransportClosed
+	}
+}
+
+func (p *pipe) Close() error {
+	p.close()
+	return nil
+}
+
+func (p *pipe) Capabilities() Capabilities {
+	return Capabilities{Name: "pipe"}
+}
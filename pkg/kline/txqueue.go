@@ -0,0 +1,111 @@
+package kline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/roffe/ismtool/pkg/message"
+)
+
+// Transaction is one request and its response
+type Transaction struct {
+	Request  message.Message
+	Response Collector
+	// Timeout bounds the exchange once it is at the head of the queue, zero leaves it to the ctx passed to Do
+	Timeout time.Duration
+}
+
+// TxResult is the response to a transaction and where the time went
+type TxResult struct {
+	Frames []message.Message
+	Wait   time.Duration // time spent queued behind other transactions
+	Exec   time.Duration // time from sending the request to the end of the response
+}
+
+// TxQueue runs transactions one at a time so responses on a shared identifier can not be mixed up
+type TxQueue struct {
+	e    *Engine
+	slot chan struct{}
+
+	// OnTransaction is called after every transaction with its result
+	OnTransaction func(tx Transaction, res TxResult, err error)
+}
+
+func NewTxQueue(e *Engine) *TxQueue {
+	return &TxQueue{
+		e:    e,
+		slot: make(chan struct{}, 1),
+	}
+}
+
+// Do waits for the transactions queued before tx, then sends its request and collects the response.
+// ctx bounds both the wait and the exchange.
+func (q *TxQueue) Do(ctx context.Context, tx Transaction) (TxResult, error) {
+	var res TxResult
+	if !q.holds(ctx) {
+		queued := time.Now()
+		if err := q.acquire(ctx); err != nil {
+			res.Wait = time.Since(queued)
+			err = fmt.Errorf("transaction %X queued: %w", tx.Request.Bytes(), err)
+			q.report(tx, res, err)
+			return res, err
+		}
+		defer q.release()
+		res.Wait = time.Since(queued)
+	}
+
+	if tx.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tx.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	frames, err := q.e.SendAndCollect(ctx, tx.Request, tx.Response)
+	res.Frames = frames
+	res.Exec = time.Since(start)
+	if err != nil {
+		err = fmt.Errorf("transaction %X: %w", tx.Request.Bytes(), err)
+	}
+	q.report(tx, res, err)
+	return res, err
+}
+
+type holderKey struct{ q *TxQueue }
+
+// Exclusive waits for the queue and keeps it while fn runs, for sequences such as open, read and close that must not be interleaved.
+// Transactions done with the ctx passed to fn skip the queue, other callers wait until fn returns.
+func (q *TxQueue) Exclusive(ctx context.Context, fn func(ctx context.Context) error) error {
+	if q.holds(ctx) {
+		return fn(ctx)
+	}
+	if err := q.acquire(ctx); err != nil {
+		return err
+	}
+	defer q.release()
+	return fn(context.WithValue(ctx, holderKey{q}, true))
+}
+
+func (q *TxQueue) holds(ctx context.Context) bool {
+	held, _ := ctx.Value(holderKey{q}).(bool)
+	return held
+}
+
+func (q *TxQueue) acquire(ctx context.Context) error {
+	select {
+	case q.slot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *TxQueue) release() {
+	<-q.slot
+}
+
+func (q *TxQueue) report(tx Transaction, res TxResult, err error) {
+	if q.OnTransaction != nil {
+		q.OnTransaction(tx, res, err)
+	}
+}
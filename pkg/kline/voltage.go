@@ -0,0 +1,140 @@
+package kline
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrLowVoltage = errors.New("supply voltage too low")
+	// ErrVoltageUnsupported is returned by a VoltageTransport whose adapter turns out not to measure the voltage
+	ErrVoltageUnsupported = errors.New("voltage reading not supported")
+)
+
+var (
+	// DefaultVoltagePoll is how often PollVoltage reads the adapter supply voltage when no period is given
+	DefaultVoltagePoll = time.Second
+	// DefaultVoltageHistory is how many voltage samples the engine keeps
+	DefaultVoltageHistory = 300
+)
+
+// VoltageSample is one supply voltage reading
+type VoltageSample struct {
+	At    time.Time
+	Volts float64
+}
+
+func (v VoltageSample) String() string {
+	return fmt.Sprintf("%.1fV", v.Volts)
+}
+
+// PollVoltage samples the supply voltage every period until the engine is closed, OnVoltage should be set before.
+// It returns ErrVoltageUnsupported if the transport does not measure the voltage, and nil if polling already runs.
+func (e *Engine) PollVoltage(period time.Duration) error {
+	if e.isClosed() {
+		return ErrClosed
+	}
+	vt, ok := e.t.(VoltageTransport)
+	if !ok {
+		return ErrVoltageUnsupported
+	}
+	if period <= 0 {
+		period = DefaultVoltagePoll
+	}
+	e.vmu.Lock()
+	polling := e.vpolling
+	e.vpolling = true
+	e.vmu.Unlock()
+	if polling {
+		return nil
+	}
+	if !e.spawn(func() { e.pollVoltage(vt, period) }) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// pollVoltage reports a failing read once until it succeeds again, and stops if the adapter turns out not to measure the voltage
+func (e *Engine) pollVoltage(vt VoltageTransport, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	failing := false
+	for {
+		_, err := e.sampleVoltage(vt)
+		switch {
+		case errors.Is(err, ErrVoltageUnsupported):
+			return
+		case err == nil:
+			failing = false
+		case !failing && e.LinkState() == LinkUp:
+			failing = true
+			e.OnError(err)
+		}
+		select {
+		case <-e.quit:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (e *Engine) sampleVoltage(vt VoltageTransport) (VoltageSample, error) {
+	e.tmu.RLock()
+	volts, err := vt.ReadVoltage()
+	e.tmu.RUnlock()
+	if err != nil {
+		return VoltageSample{}, fmt.Errorf("read voltage: %w", err)
+	}
+	s := VoltageSample{At: time.Now(), Volts: volts}
+	e.vmu.Lock()
+	e.voltage = append(e.voltage, s)
+	if n := len(e.voltage) - DefaultVoltageHistory; n > 0 {
+		e.voltage = append(e.voltage[:0], e.voltage[n:]...)
+	}
+	e.vmu.Unlock()
+	if e.OnVoltage != nil {
+		e.OnVoltage(s)
+	}
+	return s, nil
+}
+
+// Voltage returns the latest supply voltage sample, false if the transport does not measure it or none was read yet
+func (e *Engine) Voltage() (VoltageSample, bool) {
+	e.vmu.Lock()
+	defer e.vmu.Unlock()
+	if len(e.voltage) == 0 {
+		return VoltageSample{}, false
+	}
+	return e.voltage[len(e.voltage)-1], true
+}
+
+// VoltageHistory returns the kept supply voltage samples, oldest first
+func (e *Engine) VoltageHistory() []VoltageSample {
+	e.vmu.Lock()
+	defer e.vmu.Unlock()
+	return append([]VoltageSample(nil), e.voltage...)
+}
+
+// CheckVoltage reads the supply voltage and returns ErrLowVoltage if it is below min.
+// Transports and adapters that do not measure the voltage always pass.
+func (e *Engine) CheckVoltage(min float64) error {
+	if e.isClosed() {
+		return ErrClosed
+	}
+	vt, ok := e.t.(VoltageTransport)
+	if !ok || min <= 0 {
+		return nil
+	}
+	s, err := e.sampleVoltage(vt)
+	if errors.Is(err, ErrVoltageUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.Volts < min {
+		return fmt.Errorf("%w: %s, need %.1fV", ErrLowVoltage, s, min)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package message
+
+import "fmt"
+
+// Checksum selects how the trailing additive checksum of a frame is handled
+type Checksum uint8
+
+const (
+	// ChecksumNone means frames carry no checksum, the adapter deals with it
+	ChecksumNone Checksum = 0
+	// ChecksumAppend appends the checksum to transmitted frames
+	ChecksumAppend Checksum = 1 << iota
+	// ChecksumVerify verifies and strips the checksum of received frames, frames that don't match are rejected
+	ChecksumVerify
+	// ChecksumLogOnly strips the checksum of received frames, a mismatch is reported but the frame is kept
+	ChecksumLogOnly
+)
+
+func (c Checksum) String() string {
+	if c == ChecksumNone {
+		return "none"
+	}
+	var s string
+	for _, m := range []struct {
+		c    Checksum
+		name string
+	}{{ChecksumAppend, "append"}, {ChecksumVerify, "verify"}, {ChecksumLogOnly, "log"}} {
+		if c&m.c != 0 {
+			if s != "" {
+				s += "|"
+			}
+			s += m.name
+		}
+	}
+	return s
+}
+
+// Received reports if received frames end with a checksum byte
+func (c Checksum) Received() bool {
+	return c&(ChecksumVerify|ChecksumLogOnly) != 0
+}
+
+// Encode returns the frame as it should be transmitted
+func (c Checksum) Encode(frame []byte) []byte {
+	if c&ChecksumAppend == 0 {
+		return frame
+	}
+	out := make([]byte, len(frame)+1)
+	copy(out, frame)
+	out[len(frame)] = CalculateChecksum(frame)
+	return out
+}
+
+// Decode strips the checksum from a received frame. With ChecksumLogOnly the stripped frame is returned together with any *ChecksumError
+func (c Checksum) Decode(frame []byte) ([]byte, error) {
+	if !c.Received() {
+		return frame, nil
+	}
+	if len(frame) < 2 {
+		return nil, fmt.Errorf("frame too short for checksum: %X", frame)
+	}
+	data := frame[:len(frame)-1]
+	received := frame[len(frame)-1]
+	if expected := CalculateChecksum(data); received != expected {
+		err := &ChecksumError{Frame: data, Received: received, Expected: expected}
+		if c&ChecksumVerify != 0 {
+			return nil, err
+		}
+		return data, err
+	}
+	return data, nil
+}
+
+// CalculateChecksum returns the additive checksum over header and data
+func CalculateChecksum(frame []byte) (crc byte) {
+	for _, b := range frame {
+		crc += b
+	}
+	return
+}
+
+// ChecksumError is returned when the checksum of a received frame doesn't match
+type ChecksumError struct {
+	Frame    []byte // frame without checksum
+	Received byte
+	Expected byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum error %X: received %02X expected %02X", e.Frame, e.Received, e.Expected)
+}
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestChecksumEncode(t *testing.T) {
+	frame := []byte{0x22, 0x03, 0x15}
+	tests := []struct {
+		mode Checksum
+		want []byte
+	}{
+		{ChecksumNone, []byte{0x22, 0x03, 0x15}},
+		{ChecksumAppend, []byte{0x22, 0x03, 0x15, 0x3a}},
+		{ChecksumVerify, []byte{0x22, 0x03, 0x15}},
+		{ChecksumLogOnly, []byte{0x22, 0x03, 0x15}},
+		{ChecksumAppend | ChecksumVerify, []byte{0x22, 0x03, 0x15, 0x3a}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			if got := tt.mode.Encode(frame); !bytes.Equal(got, tt.want) {
+				t.Errorf("Encode(%X) = %X, want %X", frame, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumDecode(t *testing.T) {
+	good := []byte{0x22, 0x03, 0x15, 0x3a}
+	bad := []byte{0x22, 0x03, 0x15, 0x3b}
+	mismatch := &ChecksumError{Frame: []byte{0x22, 0x03, 0x15}, Received: 0x3b, Expected: 0x3a}
+	tests := []struct {
+		name    string
+		mode    Checksum
+		frame   []byte
+		want    []byte
+		wantErr *ChecksumError // nil if no checksum error is expected
+		fails   bool           // some other error is expected
+	}{
+		{"none", ChecksumNone, good, good, nil, false},
+		{"none mismatch", ChecksumNone, bad, bad, nil, false},
+		{"append", ChecksumAppend, good, good, nil, false},
+		{"verify", ChecksumVerify, good, []byte{0x22, 0x03, 0x15}, nil, false},
+		{"verify mismatch", ChecksumVerify, bad, nil, mismatch, false},
+		{"verify short", ChecksumVerify, []byte{0x22}, nil, nil, true},
+		{"log only", ChecksumLogOnly, good, []byte{0x22, 0x03, 0x15}, nil, false},
+		{"log only mismatch", ChecksumLogOnly, bad, []byte{0x22, 0x03, 0x15}, mismatch, false},
+		{"append verify", ChecksumAppend | ChecksumVerify, good, []byte{0x22, 0x03, 0x15}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.mode.Decode(tt.frame)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decode(%X) = %X, want %X", tt.frame, got, tt.want)
+			}
+			var ce *ChecksumError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.As(err, &ce) {
+					t.Fatalf("error %v, want a *ChecksumError", err)
+				}
+				if !bytes.Equal(ce.Frame, tt.wantErr.Frame) || ce.Received != tt.wantErr.Received || ce.Expected != tt.wantErr.Expected {
+					t.Errorf("checksum error %+v, want %+v", ce, tt.wantErr)
+				}
+			case tt.fails:
+				if err == nil || errors.As(err, &ce) {
+					t.Errorf("error %v, want one that is not a checksum error", err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -34,12 +34,11 @@ func New(id uint8, data []byte) *Msg {
 	}
 }
 
+// NewFromBytes parses a frame without checksum, see Checksum.Decode for frames that carry one
 func NewFromBytes(data []byte) (Message, error) {
-	//crc := calculateMessageCRC(data)
-	//if crc != data[len(data)-1] {
-	//	return nil, fmt.Errorf("CRC error %X %02X %02X", data, crc, data[len(data)-1])
-	//}
-
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty frame")
+	}
 	id := data[0] >> 4
 	messageLen := int(1 + (data[0] & 0x0f))
 	//
@@ -58,14 +57,6 @@ func NewFromBytes(data []byte) (Message, error) {
 	}, nil
 }
 
-func calculateMessageCRC(data []byte) byte {
-	var crc byte
-	for _, b := range data[:len(data)-1] {
-		crc += b
-	}
-	return crc
-}
-
 func (msg *Msg) ID() uint8 {
 	return msg.id
 }
@@ -74,11 +65,11 @@ func (msg *Msg) Data() []byte {
 	return msg.data
 }
 
-// Byte returns the byte representation of the message. the first half of byte 0 is id, second half is size. last byte is simple crc
+// Bytes returns the byte representation of the message. the first half of byte 0 is id, second half is size.
+// The checksum is not included, use Checksum.Encode when the transport needs it
 func (msg *Msg) Bytes() []byte {
 	var out bytes.Buffer
 	var firstByte byte
-	//var crc byte
 
 	firstByte = msg.id << 4
 	firstByte += byte(len(msg.data))
@@ -86,12 +77,6 @@ func (msg *Msg) Bytes() []byte {
 	out.WriteByte(firstByte)
 	out.Write(msg.data)
 
-	//for _, b := range out.Bytes() {
-	//	crc += b
-	//}
-	//
-	//out.WriteByte(crc)
-
 	return out.Bytes()
 }
 
@@ -99,11 +84,9 @@ func (msg *Msg) String() string {
 	return fmt.Sprintf("%02d:%02X %08b", msg.id, msg.data, msg.data)
 }
 
-func (msg *Msg) CRC() (crc byte) {
-	for _, b := range msg.data {
-		crc += b
-	}
-	return
+// CRC returns the checksum sent on the wire, the sum of header and data
+func (msg *Msg) CRC() byte {
+	return CalculateChecksum(msg.Bytes())
 }
 
 func Equal(msg1, msg2 Message) bool {